@@ -20,6 +20,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"log/syslog"
 	"os"
@@ -41,15 +42,18 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Stdout belongs to the response, without syslog the log is dropped.
+	// The doctor command reports a missing syslog.
 	sysLog, err := syslog.New(syslog.LOG_INFO, "Linstor FlexVolume")
 	if err != nil {
-		log.Fatal(err)
+		log.SetOutput(ioutil.Discard)
+	} else {
+		log.SetOutput(sysLog)
 	}
-	log.SetOutput(sysLog)
 
-	log.Printf("called with %s: %s", apiCall, strings.Join(os.Args[2:], ", "))
+	log.Printf("called with %s: %s", apiCall, strings.Join(api.RedactArgs(os.Args[2:]), ", "))
 
-	api := api.FlexVolumeApi{}
+	api := api.FlexVolumeApi{Version: Version}
 
 	out, ret := api.Call(os.Args[1:])
 
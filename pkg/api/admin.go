@@ -0,0 +1,91 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+)
+
+// Admin commands are run by hand or from jobs on the node, not by kubelet.
+// They share the node config with the driver calls.
+
+func (api FlexVolumeApi) newFlagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet(api.action, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	return flags
+}
+
+// outputFlag adds the flag that selects between table and json output.
+func outputFlag(flags *flag.FlagSet) *string {
+	return flags.String("o", "table", "output format, table or json")
+}
+
+func checkOutputFormat(format string) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf("output format must be table or json, not %q", format)
+	}
+	return nil
+}
+
+// formatTable lays out rows in aligned columns below header.
+func formatTable(header []string, rows [][]string) string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, r := range rows {
+		fmt.Fprintln(w, strings.Join(r, "\t"))
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// adminClient returns a linstor client for the controllers in the node
+// config, unless overridden.
+func adminClient(cfg nodeConfig, controllers string) linstorClient {
+	if controllers == "" {
+		controllers = cfg.Controllers
+	}
+	return cfg.client(controllers)
+}
+
+// resolveResource finds the resource definition for name, which can be
+// either the name of the resource in LINSTOR or the name of the Kubernetes
+// PV the driver attached it for.
+func (c linstorClient) resolveResource(name string) (resDef, error) {
+	list, err := c.resourceDefinitions()
+	if err != nil {
+		return resDef{}, err
+	}
+	for _, def := range list {
+		if def.RscName == name {
+			return def, nil
+		}
+	}
+	for _, def := range list {
+		if def.RscDfnProps.get(pvNameProp) == name {
+			return def, nil
+		}
+	}
+	return resDef{}, fmt.Errorf("no resource or PV named %s", name)
+}
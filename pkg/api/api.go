@@ -22,10 +22,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"log/syslog"
-	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	linstor "github.com/LINBIT/golinstor"
 )
@@ -48,6 +51,21 @@ func (e flexAPIErr) Error() string {
 type response struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	// Set on failures, see errors.go.
+	Code     string `json:"code,omitempty"`
+	Step     string `json:"step,omitempty"`
+	Resource string `json:"resource,omitempty"`
+	Node     string `json:"node,omitempty"`
+}
+
+type capabilities struct {
+	Attach          bool `json:"attach"`
+	SupportsMetrics bool `json:"supportsMetrics"`
+}
+
+type initResponse struct {
+	response
+	Capabilities capabilities `json:"capabilities"`
 }
 
 type attachResponse struct {
@@ -70,9 +88,13 @@ type options struct {
 	FsType      string `json:"kubernetes.io/fsType"`
 	Readwrite   string `json:"kubernetes.io/readwrite"`
 	PVCResource string `json:"kubernetes.io/pvOrVolumeName"`
+	Passphrase  string `json:"kubernetes.io/secret/passphrase"`
+	// Only passed to mount.
+	PodUID string `json:"kubernetes.io/pod.uid"`
 
 	// Homegrown volume options.
 	Resource            string `json:"resource"`
+	Controllers         string `json:"controllers"`
 	BlockSize           string `json:"blockSize"`
 	Force               string `json:"force"`
 	XFSDiscardBlocks    string `json:"xfsDiscardBlocks"`
@@ -82,26 +104,111 @@ type options struct {
 	DisklessStoragePool string `json:"disklessStoragePool"`
 	MountOpts           string `json:"mountOpts"`
 	FSOpts              string `json:"fsOpts"`
+	AutoGrow            string `json:"autoGrow"`
+	AdoptFilesystem     string `json:"adoptFilesystem"`
+	DiscardPolicy       string `json:"discardPolicy"`
+	FromSnapshot        string `json:"fromSnapshot"`
+	CloneOf             string `json:"cloneOf"`
+	AutoPlace           string `json:"autoPlace"`
+	NodeList            string `json:"nodeList"`
+	StoragePool         string `json:"storagePool"`
+	DoNotPlaceWithRegex string `json:"doNotPlaceWithRegex"`
+	Ephemeral           string `json:"ephemeral"`
+	EphemeralGrace      string `json:"ephemeralGracePeriod"`
+	Size                string `json:"size"`
+	VolumeNumber        string `json:"volumeNumber"`
+	DRBDOptions         string `json:"drbdOptions"`
+	ReplicasOnSame      string `json:"replicasOnSame"`
+	ReplicasOnDifferent string `json:"replicasOnDifferent"`
+	MinHealthyReplicas  string `json:"minHealthyReplicas"`
+	IgnoreReplicaHealth string `json:"ignoreReplicaHealth"`
+	LocalityPolicy      string `json:"localityPolicy"`
+	EncryptVolumes      string `json:"encryptVolumes"`
+	OverProvisionRatio  string `json:"overProvisionRatio"`
+	TLSCAFile           string `json:"tlsCAFile"`
+	TLSCertFile         string `json:"tlsCertFile"`
+	TLSKeyFile          string `json:"tlsKeyFile"`
+	TLSServerName       string `json:"tlsServerName"`
+	TLSMinVersion       string `json:"tlsMinVersion"`
 
 	// Parsed option ready to pass to linstor.FSUtil
-	xfsDataSW        int
-	blockSize        int64
-	force            bool
-	xfsdiscardblocks bool
+	xfsDataSW           int
+	blockSize           int64
+	force               bool
+	xfsdiscardblocks    bool
+	autoGrow            bool
+	adoptFilesystem     bool
+	fromSnapshot        []string
+	autoPlace           uint64
+	nodeList            []string
+	ephemeral           bool
+	ephemeralGrace      time.Duration
+	sizeKiB             uint64
+	volumeNumber        int
+	drbdOptions         map[string]string
+	minHealthyReplicas  int
+	ignoreReplicaHealth bool
+	encryptVolumes      bool
+	passphrase          string
+	overProvisionRatio  float64
+}
+
+// client returns a linstor client for the volume's controllers, with the TLS
+// settings of the node overridden by those of the volume.
+func (o *options) client() (linstorClient, error) {
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return linstorClient{}, err
+	}
+	c := cfg.client(o.Controllers)
+	c.tls = c.tls.merge(tlsSettings{
+		CAFile:     o.TLSCAFile,
+		CertFile:   o.TLSCertFile,
+		KeyFile:    o.TLSKeyFile,
+		ServerName: o.TLSServerName,
+		MinVersion: o.TLSMinVersion,
+	})
+	return c, nil
+}
+
+// placement returns where auto-placed replicas of the volume have to go.
+func (o *options) placement() placement {
+	return placement{
+		replicas:  o.autoPlace,
+		same:      strings.Fields(o.ReplicasOnSame),
+		different: strings.Fields(o.ReplicasOnDifferent),
+	}
 }
 
-func (o *options) getResource() string {
+// getResource returns the name of the volume's resource when used on node.
+func (o *options) getResource(node string) string {
+	if o.ephemeral {
+		return ephemeralName(o.volumeName(), node)
+	}
 	if o.Resource != "" {
 		return o.Resource
 	}
 	return o.PVCResource
 }
 
+// volumeName returns the name Kubernetes knows the volume by.
+func (o *options) volumeName() string {
+	if o.PVCResource != "" {
+		return o.PVCResource
+	}
+	return o.Resource
+}
+
 func parseOptions(s string) (options, error) {
+	opts, err := decodeOptions(s)
+	return opts, withCode(codeInvalidOptions, err)
+}
+
+func decodeOptions(s string) (options, error) {
 	opts := options{}
 	err := json.Unmarshal([]byte(s), &opts)
 	if err != nil {
-		return opts, flexAPIErr{fmt.Sprintf("couldn't parse options from %s", s)}
+		return opts, flexAPIErr{fmt.Sprintf("couldn't parse options from %s", redactOptions(s))}
 	}
 
 	// BlockSizes of zero are ignored by FSUtil
@@ -138,41 +245,213 @@ func parseOptions(s string) (options, error) {
 		return opts, err
 	}
 
+	if opts.AutoGrow == "" {
+		opts.AutoGrow = "true"
+	}
+	opts.autoGrow, err = strconv.ParseBool(opts.AutoGrow)
+	if err != nil {
+		return opts, err
+	}
+
+	// Volumes are either mounted with online discard, or left for the trim
+	// command to discard in batches.
+	switch opts.DiscardPolicy {
+	case "", "batch":
+	case "online":
+		if opts.MountOpts == "" {
+			opts.MountOpts = "defaults"
+		}
+		opts.MountOpts += ",discard"
+	default:
+		return opts, fmt.Errorf("discardPolicy must be batch or online, not %q", opts.DiscardPolicy)
+	}
+
+	if opts.FromSnapshot != "" {
+		opts.fromSnapshot = strings.SplitN(opts.FromSnapshot, "/", 2)
+		if len(opts.fromSnapshot) != 2 || opts.fromSnapshot[0] == "" || opts.fromSnapshot[1] == "" {
+			return opts, fmt.Errorf("fromSnapshot must be <resource>/<snapshot>, not %q", opts.FromSnapshot)
+		}
+		if opts.CloneOf != "" {
+			return opts, fmt.Errorf("only one of fromSnapshot and cloneOf may be set")
+		}
+	}
+
+	if opts.AutoPlace == "" {
+		opts.AutoPlace = "0"
+	}
+	opts.autoPlace, err = strconv.ParseUint(opts.AutoPlace, 10, 64)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.nodeList = strings.Fields(opts.NodeList)
+
+	if opts.Ephemeral == "" {
+		opts.Ephemeral = "false"
+	}
+	opts.ephemeral, err = strconv.ParseBool(opts.Ephemeral)
+	if err != nil {
+		return opts, err
+	}
+
+	if opts.EphemeralGrace == "" {
+		opts.EphemeralGrace = "0s"
+	}
+	opts.ephemeralGrace, err = time.ParseDuration(opts.EphemeralGrace)
+	if err != nil {
+		return opts, err
+	}
+
+	if opts.Size != "" {
+		opts.sizeKiB, err = parseSizeKiB(opts.Size)
+		if err != nil {
+			return opts, err
+		}
+	}
+	if opts.ephemeral && opts.sizeKiB == 0 && opts.FromSnapshot == "" && opts.CloneOf == "" {
+		return opts, fmt.Errorf("ephemeral volumes need a size")
+	}
+
+	if opts.VolumeNumber == "" {
+		opts.VolumeNumber = "0"
+	}
+	volumeNumber, err := strconv.ParseUint(opts.VolumeNumber, 10, 16)
+	if err != nil {
+		return opts, err
+	}
+	opts.volumeNumber = int(volumeNumber)
+
+	opts.drbdOptions, err = parseDRBDOptions(opts.DRBDOptions)
+	if err != nil {
+		return opts, err
+	}
+
+	switch opts.LocalityPolicy {
+	case "":
+		opts.LocalityPolicy = localityNever
+	case localityNever, localityPreferred, localityRequired:
+	default:
+		return opts, fmt.Errorf("localityPolicy must be never, preferred or required, not %q", opts.LocalityPolicy)
+	}
+
+	switch strings.ToLower(opts.EncryptVolumes) {
+	case "", "no":
+	case "yes":
+		opts.encryptVolumes = true
+	default:
+		opts.encryptVolumes, err = strconv.ParseBool(opts.EncryptVolumes)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	opts.passphrase, err = decodeSecret(opts.Passphrase)
+	if err != nil {
+		return opts, err
+	}
+	addSecret(opts.passphrase)
+
+	if opts.OverProvisionRatio == "" {
+		opts.OverProvisionRatio = "1"
+	}
+	opts.overProvisionRatio, err = strconv.ParseFloat(opts.OverProvisionRatio, 64)
+	if err != nil {
+		return opts, err
+	}
+
+	if opts.MinHealthyReplicas == "" {
+		opts.MinHealthyReplicas = "0"
+	}
+	opts.minHealthyReplicas, err = strconv.Atoi(opts.MinHealthyReplicas)
+	if err != nil {
+		return opts, err
+	}
+	if opts.minHealthyReplicas < 0 {
+		return opts, fmt.Errorf("minHealthyReplicas must not be negative, not %d", opts.minHealthyReplicas)
+	}
+
+	if opts.IgnoreReplicaHealth == "" {
+		opts.IgnoreReplicaHealth = "false"
+	}
+	opts.ignoreReplicaHealth, err = strconv.ParseBool(opts.IgnoreReplicaHealth)
+	if err != nil {
+		return opts, err
+	}
+
+	if opts.AdoptFilesystem == "" {
+		opts.AdoptFilesystem = "false"
+	}
+	opts.adoptFilesystem, err = strconv.ParseBool(opts.AdoptFilesystem)
+	if err != nil {
+		return opts, err
+	}
+
 	return opts, nil
 }
 
 var logOutput io.Writer
 
 func init() {
+	// Without syslog, the log is dropped rather than failing every call;
+	// doctor reports it.
 	out, err := syslog.New(syslog.LOG_INFO, "Linstor FlexVolume")
 	if err != nil {
-		log.Fatal(err)
+		logOutput = ioutil.Discard
+		return
 	}
 
 	logOutput = out
 }
 
 type FlexVolumeApi struct {
-	action string
+	// Version of the driver, reported and compared by install.
+	Version string
+	action  string
 }
 
 func (api FlexVolumeApi) fmtAPIError(err error) (string, int) {
+	code := errorCodeOf(err)
 	res, _ := json.Marshal(response{
-		Status:  "Failure",
-		Message: flexAPIErr{fmt.Sprintf("%s: %v", api.action, err)}.Error(),
+		Status:   "Failure",
+		Message:  flexAPIErr{fmt.Sprintf("%s: %v", api.action, err)}.Error(),
+		Code:     string(code),
+		Step:     currentStep,
+		Resource: currentResource,
+		Node:     currentNode,
 	})
-	return string(res), EXITBADAPICALL
+	return string(res), exitCodes[code]
 }
 
+// Call runs the driver action in args[0] and returns the response and exit code.
 func (api *FlexVolumeApi) Call(args []string) (string, int) {
+	start := time.Now()
+	retryDeadline = start.Add(retryBudget())
+	dryRun = dryRunEnabled()
+	out, ret := api.call(args)
+	if servingController != "" {
+		log.Printf("%s served by controller %s", api.action, servingController)
+	}
+	if dryRun {
+		log.Printf("dry run of %s planned: %s", api.action, strings.Join(plan, "; "))
+		return withPlan(out), ret
+	}
+	if api.action != "" {
+		recordCall(api.action, ret, time.Since(start))
+	}
+	return out, ret
+}
+
+func (api *FlexVolumeApi) call(args []string) (string, int) {
 	if len(args) < 1 {
 		res, _ := json.Marshal(response{
 			Status:  "Failure",
 			Message: flexAPIErr{"No driver action! Valid actions are: init, attach, detach, mountdevice, unmountdevice, isattached"}.Error(),
+			Code:    string(codeInvalidArguments),
 		})
 		return string(res), EXITBADAPICALL
 	}
 	api.action = args[0]
+	step(api.action)
 	switch api.action {
 	case "init":
 		return api.init()
@@ -182,7 +461,10 @@ func (api *FlexVolumeApi) Call(args []string) (string, int) {
 		}
 		return api.attach(args[1], args[2])
 	case "waitforattach":
-		return api.waitForAttach()
+		if len(args) < 3 {
+			return tooFewArgsResponse(args)
+		}
+		return api.waitForAttach(args[2])
 	case "detach":
 		if len(args) < 3 {
 			return tooFewArgsResponse(args)
@@ -198,6 +480,11 @@ func (api *FlexVolumeApi) Call(args []string) (string, int) {
 			return tooFewArgsResponse(args)
 		}
 		return api.unmountDevice(args[1])
+	case "mount":
+		if len(args) < 3 {
+			return tooFewArgsResponse(args)
+		}
+		return api.mount(args[1], args[2])
 	case "unmount":
 		if len(args) < 2 {
 			return tooFewArgsResponse(args)
@@ -208,17 +495,53 @@ func (api *FlexVolumeApi) Call(args []string) (string, int) {
 			return tooFewArgsResponse(args)
 		}
 		return api.isAttached(args[1], args[2])
+	case "trim":
+		return api.trim(args[1:])
+	case "snapshot":
+		return api.snapshot(args[1:])
+	case "ephemeral":
+		return api.ephemeralCmd(args[1:])
+	case "topology":
+		return api.topology(args[1:])
+	case "doctor":
+		return api.doctor(args[1:])
+	case "status":
+		return api.status(args[1:])
+	case "gc":
+		return api.gc(args[1:])
+	case "install":
+		return api.install(args[1:])
+	case "stats":
+		if len(args) < 2 {
+			return tooFewArgsResponse(args)
+		}
+		return api.stats(args[1])
 	default:
+		// Not counted in the metrics, the action could be anything.
+		api.action = ""
 		res, _ := json.Marshal(response{
 			Status:  "Not supported",
-			Message: flexAPIErr{fmt.Sprintf("Unsupported driver action: %s", api.action)}.Error(),
+			Message: flexAPIErr{fmt.Sprintf("Unsupported driver action: %s", args[0])}.Error(),
+			Code:    string(codeUnsupported),
 		})
 		return string(res), EXITBADAPICALL
 	}
 }
 
 func (api FlexVolumeApi) init() (string, int) {
-	res, _ := json.Marshal(response{Status: "Success"})
+	// Kubelet calls init when it finds the driver, a good time to map the
+	// node's topology labels.
+	if cfg, err := loadNodeConfig(); err == nil {
+		startTopologySync(cfg)
+	}
+
+	res, _ := json.Marshal(initResponse{
+		response: response{Status: "Success"},
+		Capabilities: capabilities{
+			Attach:          true,
+			SupportsMetrics: true,
+		},
+	})
 	return string(res), EXITSUCCESS
 }
 
@@ -228,30 +551,85 @@ func (api FlexVolumeApi) attach(rawOpts, node string) (string, int) {
 		return api.fmtAPIError(err)
 	}
 
+	target(opts.getResource(node), node)
+	c, err := opts.client()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	step("encryption")
+	err = unlockEncryption(c, opts, node)
+	if err != nil {
+		return api.fmtAPIError(withCode(codeEncryptionFailed, err))
+	}
+
+	step("provision")
+	err = provision(c, opts, node)
+	if err != nil {
+		return api.fmtAPIError(withCode(codeProvisionFailed,
+			fmt.Errorf("failed to create resource %s: %w", opts.getResource(node), err)))
+	}
+
+	def, err := c.resourceDefinition(opts.getResource(node))
+	if err != nil {
+		if stop, ok := api.planStops(err); ok {
+			return stop, EXITSUCCESS
+		}
+		return api.fmtAPIError(err)
+	}
+	err = def.hasVolume(opts.volumeNumber)
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	if len(opts.drbdOptions) != 0 {
+		step("drbd-options")
+		err = applyDRBDOptions(c, def, opts.drbdOptions)
+		if err != nil {
+			return api.fmtAPIError(err)
+		}
+	}
+
+	step("locality")
+	err = ensureLocalReplica(c, def, node, opts)
+	if stop, ok := api.planStops(err); ok {
+		return stop, EXITSUCCESS
+	}
+	if err != nil {
+		return api.fmtAPIError(withCode(codeLocalityFailed, err))
+	}
+
 	resource := linstor.NewResourceDeployment(linstor.ResourceDeploymentConfig{
-		Name:                opts.getResource(),
+		Name:                opts.getResource(node),
 		ClientList:          []string{node},
 		DisklessStoragePool: opts.DisklessStoragePool,
+		Controllers:         opts.Controllers,
 		LogOut:              logOutput,
 	})
 
-	err = resource.Assign()
+	step("assign")
+	err = assign(c, resource)
 	if err != nil {
-		res, _ := json.Marshal(response{
-			Status: "Failure",
-			Message: flexAPIErr{fmt.Sprintf(
-				"%s: failed to assign resource %s: %v", api.action, resource.Name, err)}.Error(),
-		})
-		return string(res), EXITDRBDFAILURE
+		return api.fmtAPIError(withCode(codeAssignFailed,
+			fmt.Errorf("failed to assign resource %s: %w", resource.Name, err)))
 	}
 
-	path, err := resource.GetDevPath(node, false)
+	// Remember the PV, so admin commands can find the resource by its name.
+	if opts.PVCResource != "" && !opts.ephemeral && def.RscDfnProps.get(pvNameProp) != opts.PVCResource {
+		err = c.setResourceDefinitionProps(resource.Name, map[string]string{pvNameProp: opts.PVCResource})
+		if err != nil {
+			return api.fmtAPIError(err)
+		}
+	}
+
+	step("device")
+	path, err := c.devicePath(resource.Name, opts.volumeNumber, node)
+	if stop, ok := api.planStops(err); ok {
+		return stop, EXITSUCCESS
+	}
 	if err != nil {
-		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: unable to find device path for resource %s: %v", api.action, resource.Name, err)}.Error(),
-		})
-		return string(res), EXITDRBDFAILURE
+		return api.fmtAPIError(withCode(codeDeviceNotFound,
+			fmt.Errorf("unable to find device path for resource %s: %w", resource.Name, err)))
 	}
 
 	res, _ := json.Marshal(attachResponse{
@@ -263,28 +641,91 @@ func (api FlexVolumeApi) attach(rawOpts, node string) (string, int) {
 	return string(res), EXITSUCCESS
 }
 
-func (api FlexVolumeApi) waitForAttach() (string, int) {
-	res, _ := json.Marshal(response{Status: "Success"})
+func (api FlexVolumeApi) waitForAttach(rawOpts string) (string, int) {
+	opts, err := parseOptions(rawOpts)
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	localNode, err := cfg.localNode()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	target(opts.getResource(localNode), localNode)
+
+	c, err := opts.client()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	path, err := c.waitForDevicePath(opts.getResource(localNode), opts.volumeNumber, localNode, 3)
+	if err != nil {
+		return api.fmtAPIError(withCode(codeDeviceNotFound, err))
+	}
+
+	res, _ := json.Marshal(attachResponse{
+		Device: path,
+		response: response{
+			Status: "Success",
+		},
+	})
 	return string(res), EXITSUCCESS
 }
 
 func (api FlexVolumeApi) detach(name, node string) (string, int) {
+	// Detach is not passed any volume options, the controllers come from the node config.
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	target(name, node)
+	c := cfg.client(cfg.Controllers)
+
+	eph, err := c.ephemeralResource(name, node)
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	if eph != nil {
+		name = eph.RscName
+		target(name, node)
+	}
 
 	resource := linstor.NewResourceDeployment(
 		linstor.ResourceDeploymentConfig{
-			Name:   name,
-			LogOut: logOutput,
+			Name:        name,
+			Controllers: cfg.Controllers,
+			LogOut:      logOutput,
 		})
 
-	// Do not unassign resources that have local storage.
-	if !resource.IsClient(node) {
+	if eph != nil {
+		step("release")
+		err = releaseEphemeral(c, resource, *eph, node)
+		if err != nil {
+			return api.fmtAPIError(withCode(codeUnassignFailed, err))
+		}
 		res, _ := json.Marshal(response{Status: "Success"})
 		return string(res), EXITSUCCESS
 	}
 
-	err := resource.Unassign(node)
+	// Do not unassign resources that have local storage, unless it was
+	// only placed there for the locality policy.
+	detach, err := detachable(c, name, node)
 	if err != nil {
-		api.fmtAPIError(err)
+		return api.fmtAPIError(err)
+	}
+	if !detach {
+		res, _ := json.Marshal(response{Status: "Success"})
+		return string(res), EXITSUCCESS
+	}
+
+	step("unassign")
+	err = unassign(c, resource, node)
+	if err != nil {
+		return api.fmtAPIError(withCode(codeUnassignFailed, err))
 	}
 
 	res, _ := json.Marshal(response{Status: "Success"})
@@ -296,32 +737,76 @@ func (api FlexVolumeApi) mountDevice(path, rawOpts string) (string, int) {
 	if err != nil {
 		return api.fmtAPIError(err)
 	}
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	localNode, err := cfg.localNode()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+
 	r := linstor.NewResourceDeployment(
-		linstor.ResourceDeploymentConfig{Name: opts.getResource(),
-			LogOut: logOutput,
+		linstor.ResourceDeploymentConfig{Name: opts.getResource(localNode),
+			Controllers: opts.Controllers,
+			LogOut:      logOutput,
 		})
+	target(r.Name, localNode)
 
-	mounter := linstor.FSUtil{
-		ResourceDeployment: &r,
-		FSType:             opts.FsType,
-		BlockSize:          opts.blockSize,
-		Force:              opts.force,
-		XFSDiscardBlocks:   opts.xfsdiscardblocks,
-		XFSDataSU:          opts.XFSDataSU,
-		XFSDataSW:          opts.xfsDataSW,
-		XFSLogDev:          opts.XFSLogDev,
-		MountOpts:          opts.MountOpts,
-		FSOpts:             opts.FSOpts,
+	c, err := opts.client()
+	if err != nil {
+		return api.fmtAPIError(err)
 	}
 
-	localNode, err := os.Hostname()
+	step("device")
+	device, err := c.waitForDevicePath(r.Name, opts.volumeNumber, localNode, 3)
 	if err != nil {
-		return api.fmtAPIError(err)
+		return api.fmtAPIError(withCode(codeDeviceNotFound,
+			fmt.Errorf("unable to mount device, couldn't find Resource device path: %w", err)))
 	}
 
-	err = mounter.Mount(path, localNode)
+	step("replica-health")
+	err = checkReplicaHealth(c, r.Name, localNode, opts)
 	if err != nil {
-		return api.fmtAPIError(err)
+		return api.fmtAPIError(withCode(codeReplicasUnhealthy, err))
+	}
+
+	mounter := volumeFS{
+		FSUtil: linstor.FSUtil{
+			ResourceDeployment: &r,
+			FSType:             opts.FsType,
+			BlockSize:          opts.blockSize,
+			Force:              opts.force,
+			XFSDiscardBlocks:   opts.xfsdiscardblocks,
+			XFSDataSU:          opts.XFSDataSU,
+			XFSDataSW:          opts.xfsDataSW,
+			XFSLogDev:          opts.XFSLogDev,
+			MountOpts:          opts.MountOpts,
+			FSOpts:             opts.FSOpts,
+		},
+		client: c,
+		device: device,
+		volume: opts.volumeNumber,
+		adopt:  opts.adoptFilesystem,
+	}
+
+	step("mount")
+	err = mounter.Mount(path)
+	if err != nil {
+		return api.fmtAPIError(withCode(codeMountFailed, err))
+	}
+
+	// The volume definition may have been resized since the filesystem was created.
+	if opts.autoGrow {
+		step("grow")
+		err = growFS(device, path, opts.FsType)
+		// A filesystem that was only planned to be mounted can't be sized.
+		if stop, ok := api.planStops(err); ok {
+			return stop, EXITSUCCESS
+		}
+		if err != nil {
+			return api.fmtAPIError(withCode(codeGrowFailed, err))
+		}
 	}
 
 	res, _ := json.Marshal(response{Status: "Success"})
@@ -329,16 +814,67 @@ func (api FlexVolumeApi) mountDevice(path, rawOpts string) (string, int) {
 }
 
 func (api FlexVolumeApi) unmountDevice(path string) (string, int) {
+	// Only the mount path is passed, log which volume is behind it.
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	resource, volume, err := mountedVolume(path)
+	if err != nil {
+		log.Printf("unmounting %s: %v", path, err)
+	} else {
+		node, _ := cfg.localNode()
+		target(resource, node)
+		log.Printf("unmounting volume %d of resource %s from %s", volume, resource, path)
+	}
+
 	return api.unmount(path)
 }
 
-func (api FlexVolumeApi) unmount(path string) (string, int) {
-	umounter := linstor.FSUtil{}
-
-	err := umounter.UnMount(path)
+// mount bind mounts the global mount of the volume into the pod at path, as
+// kubelet would by itself, after claiming ephemeral volumes for the pod. It
+// is the only call kubelet tells which pod a volume is for.
+func (api FlexVolumeApi) mount(path, rawOpts string) (string, int) {
+	opts, err := parseOptions(rawOpts)
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	cfg, err := loadNodeConfig()
 	if err != nil {
 		return api.fmtAPIError(err)
 	}
+	localNode, err := cfg.localNode()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	target(opts.getResource(localNode), localNode)
+
+	if opts.ephemeral && opts.PodUID != "" {
+		c, err := opts.client()
+		if err != nil {
+			return api.fmtAPIError(err)
+		}
+		step("claim")
+		err = claimEphemeral(c, cfg, opts.getResource(localNode), opts.PodUID)
+		if err != nil {
+			return api.fmtAPIError(err)
+		}
+	}
+
+	step("mount")
+	err = bindMount(filepath.Join(cfg.mountsDir(), opts.volumeName()), path)
+	if err != nil {
+		return api.fmtAPIError(withCode(codeMountFailed, err))
+	}
+	res, _ := json.Marshal(response{Status: "Success"})
+	return string(res), EXITSUCCESS
+}
+
+func (api FlexVolumeApi) unmount(path string) (string, int) {
+	err := unmountPath(path)
+	if err != nil {
+		return api.fmtAPIError(withCode(codeUnmountFailed, err))
+	}
 	res, _ := json.Marshal(response{Status: "Success"})
 	return string(res), EXITSUCCESS
 }
@@ -346,15 +882,11 @@ func (api FlexVolumeApi) unmount(path string) (string, int) {
 func (api FlexVolumeApi) getVolumeName(s []string) (string, int) {
 	opts, err := parseOptions(s[1])
 	if err != nil {
-		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: %v", api.action, err)}.Error(),
-		})
-		return string(res), EXITBADAPICALL
+		return api.fmtAPIError(err)
 	}
 
 	res, _ := json.Marshal(getVolNameResponse{
-		VolumeName: opts.getResource(),
+		VolumeName: opts.getResource(""),
 		response: response{
 			Status: "Success",
 		},
@@ -368,12 +900,13 @@ func (api FlexVolumeApi) isAttached(rawOpts, node string) (string, int) {
 		return api.fmtAPIError(err)
 	}
 
-	resource := linstor.NewResourceDeployment(
-		linstor.ResourceDeploymentConfig{Name: opts.getResource(),
-			LogOut: logOutput,
-		})
+	c, err := opts.client()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
 
-	ok, err := resource.OnNode(node)
+	target(opts.getResource(node), node)
+	ok, err := c.onNode(opts.getResource(node), opts.volumeNumber, node)
 	if err != nil {
 		return api.fmtAPIError(err)
 	}
@@ -398,6 +931,7 @@ func tooFewArgsResponse(s []string) (string, int) {
 	res, _ := json.Marshal(response{
 		Status:  "Failure",
 		Message: flexAPIErr{fmt.Sprintf("%s: too few arguments passed: %s", s[0], s)}.Error(),
+		Code:    string(codeInvalidArguments),
 	})
 	return string(res), EXITBADAPICALL
 }
@@ -0,0 +1,168 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// poolKey identifies a storage pool on a node.
+type poolKey struct {
+	node, pool string
+}
+
+// thin reports whether the storage pool is thin provisioned, such as with
+// the LvmThinDriver or ZfsThinDriver.
+func (sp storagePool) thin() bool {
+	return strings.Contains(strings.ToLower(sp.Driver), "thin")
+}
+
+// availableKiB returns how much more the storage pool can take, given the
+// KiB already provisioned in it. Thin pools may promise ratio times their
+// size, minus what they already promised to the volumes in them, however
+// little of it is written.
+func (sp storagePool) availableKiB(ratio float64, provisioned int64) int64 {
+	if !sp.thin() {
+		return sp.FreeSpace.FreeCapacity
+	}
+	return int64(float64(sp.FreeSpace.TotalCapacity)*ratio) - provisioned
+}
+
+// provisionedKiB sums up the sizes of the volumes placed in each storage
+// pool, by node.
+func provisionedKiB(c linstorClient) (map[poolKey]int64, error) {
+	defs, err := c.resourceDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.resources()
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]map[int]int64{}
+	for _, d := range defs {
+		sizes[d.RscName] = map[int]int64{}
+		for _, v := range d.VlmDfns {
+			sizes[d.RscName][v.VlmNr] = int64(v.VlmSize)
+		}
+	}
+
+	provisioned := map[poolKey]int64{}
+	for _, r := range res {
+		if r.diskless() {
+			continue
+		}
+		for _, v := range r.Vlms {
+			provisioned[poolKey{r.NodeName, v.StorPoolName}] += sizes[r.Name][v.VlmNr]
+		}
+	}
+	return provisioned, nil
+}
+
+// checkCapacity makes sure a new resource of sizeKiB fits into the storage
+// pool on enough nodes: all nodes in nodeList, or as many as the placement
+// needs replicas, following its constraints, out of the nodes in among, or
+// all nodes if among is empty. It returns the nodes it placed the replicas
+// on, which is nodeList if given. Resources that don't fit fail here, naming
+// the pools and the missing space, instead of with an error from deep within
+// LINSTOR.
+func checkCapacity(c linstorClient, pool string, sizeKiB uint64, ratio float64, nodeList, among []string, p placement) ([]string, error) {
+	nodes, err := c.nodes()
+	if err != nil {
+		return nil, err
+	}
+	pools, err := c.storagePools()
+	if err != nil {
+		return nil, err
+	}
+	provisioned, err := provisionedKiB(c)
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, n := range nodes {
+		known[n.Name] = true
+	}
+	var unknown []string
+	for _, n := range nodeList {
+		if !known[n] {
+			unknown = append(unknown, n)
+		}
+	}
+	if len(unknown) != 0 {
+		return nil, apiError{codeInvalidOptions, fmt.Errorf("nodes not known to LINSTOR: %s", strings.Join(unknown, ", "))}
+	}
+
+	candidates := map[string]bool{}
+	for _, n := range nodeList {
+		candidates[n] = true
+	}
+	if len(nodeList) == 0 {
+		for _, n := range among {
+			candidates[n] = true
+		}
+	}
+
+	var fits []node
+	var short []string
+	for _, n := range nodes {
+		if len(candidates) != 0 && !candidates[n.Name] {
+			continue
+		}
+
+		found := false
+		for _, sp := range pools {
+			if sp.NodeName != n.Name || sp.StorPoolName != pool {
+				continue
+			}
+			found = true
+			if avail := sp.availableKiB(ratio, provisioned[poolKey{n.Name, pool}]); avail < int64(sizeKiB) {
+				short = append(short, fmt.Sprintf("%s on %s has %d KiB available, %d KiB missing",
+					pool, n.Name, avail, int64(sizeKiB)-avail))
+			} else {
+				fits = append(fits, n)
+			}
+		}
+		if !found && len(candidates) != 0 {
+			short = append(short, fmt.Sprintf("node %s has no storage pool %s", n.Name, pool))
+		}
+	}
+	sort.Strings(short)
+
+	if len(nodeList) != 0 {
+		if len(short) != 0 {
+			return nil, apiError{codeNoSpace, fmt.Errorf("not enough space for %d KiB: %s", sizeKiB, strings.Join(short, "; "))}
+		}
+		return nodeList, nil
+	}
+
+	selected, err := p.selectNodes(fits)
+	if err != nil {
+		if len(short) != 0 {
+			return nil, apiError{codeNoSpace, fmt.Errorf("storage pool %s: %v; not enough space for %d KiB: %s",
+				pool, err, sizeKiB, strings.Join(short, "; "))}
+		}
+		return nil, apiError{codePlacementFailed, fmt.Errorf("storage pool %s: %v", pool, err)}
+	}
+	return selected, nil
+}
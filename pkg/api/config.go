@@ -0,0 +1,121 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The node config is read from here, unless the environment points elsewhere.
+const (
+	defaultConfigPath = "/etc/linstor-flexvolume/config.json"
+	configPathEnv     = "LINSTOR_FLEXVOLUME_CONFIG"
+)
+
+// Kubelet mounts flexvolumes of this driver below its root directory.
+const (
+	defaultKubeletDir = "/var/lib/kubelet"
+	driverName        = "linbit/linstor-flexvolume"
+)
+
+// Kubelet looks for the driver in a directory named after the driver below
+// its volume plugin directory.
+const (
+	defaultPluginDir = "/usr/libexec/kubernetes/kubelet-plugins/volume/exec"
+	pluginDirName    = "linbit~linstor-flexvolume"
+)
+
+// nodeConfig holds node local settings. Kubelet passes volume options only to
+// the driver calls that need them, everything else is configured here.
+type nodeConfig struct {
+	Controllers string `json:"controllers"`
+	NodeName    string `json:"nodeName"`
+	KubeletDir  string `json:"kubeletDir"`
+	PluginDir   string `json:"pluginDir"`
+	MetricsFile string `json:"metricsFile"`
+	DryRun      bool   `json:"dryRun"`
+	// How long a call may keep retrying LINSTOR, as a Go duration.
+	RetryBudget string `json:"retryBudget"`
+	// Node local state, such as the controller that answered last.
+	StateDir      string `json:"stateDir"`
+	ControllerTTL string `json:"controllerTTL"`
+	Kubeconfig    string `json:"kubeconfig"`
+	// Maps Kubernetes node labels to LINSTOR node aux properties.
+	TopologyLabels map[string]string `json:"topologyLabels"`
+	// TLS to the controllers, volume options can override each setting.
+	TLS tlsSettings `json:"tls"`
+}
+
+func configPath() string {
+	if p := os.Getenv(configPathEnv); p != "" {
+		return p
+	}
+	return defaultConfigPath
+}
+
+// loadNodeConfig reads the node config, a missing file is the same as an
+// empty one.
+func loadNodeConfig() (nodeConfig, error) {
+	cfg := nodeConfig{}
+
+	data, err := ioutil.ReadFile(configPath())
+	if err != nil && !os.IsNotExist(err) {
+		return cfg, err
+	}
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("couldn't parse node config %s: %v", configPath(), err)
+		}
+	}
+
+	if cfg.KubeletDir == "" {
+		cfg.KubeletDir = defaultKubeletDir
+	}
+	if cfg.PluginDir == "" {
+		cfg.PluginDir = defaultPluginDir
+	}
+	if cfg.StateDir == "" {
+		cfg.StateDir = defaultStateDir
+	}
+	return cfg, nil
+}
+
+// client returns a linstor client for controllers, using the node's TLS
+// settings.
+func (c nodeConfig) client(controllers string) linstorClient {
+	return linstorClient{controllers: controllers, tls: c.TLS}
+}
+
+// localNode returns the name of this node in LINSTOR.
+func (c nodeConfig) localNode() (string, error) {
+	if c.NodeName != "" {
+		return c.NodeName, nil
+	}
+	return os.Hostname()
+}
+
+// mountsDir is where kubelet has the driver mount devices before bind
+// mounting them into pods.
+func (c nodeConfig) mountsDir() string {
+	return filepath.Join(c.KubeletDir, "plugins", "kubernetes.io", "flexvolume", driverName, "mounts")
+}
@@ -0,0 +1,165 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Tools the driver runs, besides the linstor client.
+var requiredTools = []string{
+	"blkid", "wipefs", "blockdev", "mkfs", "mkfs.xfs", "mkfs.ext4", "mount", "umount",
+	"findmnt", "drbdsetup", "xfs_info", "xfs_growfs", "xfs_admin", "dumpe2fs", "resize2fs", "tune2fs", "fstrim",
+}
+
+type checkResult struct {
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+type doctorResponse struct {
+	response
+	Checks []checkResult `json:"checks"`
+}
+
+// doctor checks the prerequisites of the driver on this node. It exits
+// non-zero if any check fails, so it can serve as a readiness probe.
+func (api FlexVolumeApi) doctor(args []string) (string, int) {
+	flags := api.newFlagSet()
+	output := outputFlag(flags)
+	controllers := flags.String("controllers", "", "LINSTOR controllers, overrides the node config")
+	if err := flags.Parse(args); err != nil {
+		return api.fmtAPIError(err)
+	}
+	if err := checkOutputFormat(*output); err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	resp := doctorResponse{response: response{Status: "Success"}}
+	check := func(name string, err error, hint string) bool {
+		r := checkResult{Check: name, Passed: err == nil}
+		if err != nil {
+			r.Detail, r.Hint = err.Error(), hint
+			resp.Status = "Failure"
+		}
+		resp.Checks = append(resp.Checks, r)
+		return err == nil
+	}
+
+	cfg, err := loadNodeConfig()
+	check("node config", err, fmt.Sprintf("fix the JSON in %s", configPath()))
+	localNode, err := cfg.localNode()
+	check("node name", err, "set nodeName in the node config")
+
+	_, err = os.Stat("/dev/log")
+	check("syslog", err, "run a syslog daemon, the driver logs to /dev/log")
+
+	check("DRBD 9 kernel module", drbdVersion(), "install DRBD 9 and load it with modprobe drbd")
+
+	for _, tool := range requiredTools {
+		_, err := exec.LookPath(tool)
+		check("tool "+tool, err, "install the package that provides "+tool)
+	}
+
+	check("plugin directory", checkPluginDir(cfg), fmt.Sprintf(
+		"install the driver as %s", filepath.Join(cfg.PluginDir, pluginDirName, "linstor-flexvolume")))
+
+	if len(cfg.topologyMapping()) != 0 {
+		_, err := nodeLabels(cfg, localNode)
+		check("topology labels", err, "install kubectl and set kubeconfig in the node config to one that may get "+
+			"the node, or set topologyLabels to {} to turn the mapping off")
+	}
+
+	_, err = exec.LookPath("linstor")
+	if check("linstor client", err, "install the linstor client") {
+		c := adminClient(cfg, *controllers)
+		nodes, err := c.nodes()
+		if check("controller reachable", err, "set controllers in the node config or start the controller") {
+			found := fmt.Errorf("node %s not found in LINSTOR", localNode)
+			for _, n := range nodes {
+				if n.Name == localNode {
+					found = nil
+				}
+			}
+			check("node registered", found, "create the node with linstor node create, named as uname -n or nodeName")
+		}
+	}
+
+	ret := EXITSUCCESS
+	if resp.Status != "Success" {
+		ret = EXITBADAPICALL
+	}
+
+	if *output == "json" {
+		res, _ := json.Marshal(resp)
+		return string(res), ret
+	}
+
+	rows := [][]string{}
+	for _, r := range resp.Checks {
+		result := "pass"
+		if !r.Passed {
+			result = "FAIL"
+		}
+		rows = append(rows, []string{r.Check, result, r.Detail, r.Hint})
+	}
+	return formatTable([]string{"CHECK", "RESULT", "DETAIL", "HINT"}, rows), ret
+}
+
+// drbdVersion returns an error unless DRBD 9 is loaded.
+func drbdVersion() error {
+	data, err := ioutil.ReadFile("/proc/drbd")
+	if err != nil {
+		return fmt.Errorf("DRBD is not loaded: %v", err)
+	}
+	first := strings.SplitN(string(data), "\n", 2)[0]
+	if !strings.HasPrefix(first, "version: 9.") {
+		return fmt.Errorf("DRBD 9 is required, found %q", first)
+	}
+	return nil
+}
+
+// checkPluginDir makes sure kubelet finds the driver where it looks for it.
+func checkPluginDir(cfg nodeConfig) error {
+	dir := filepath.Join(cfg.PluginDir, pluginDirName)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	bin := filepath.Join(dir, "linstor-flexvolume")
+	fi, err = os.Stat(bin)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", bin)
+	}
+	return nil
+}
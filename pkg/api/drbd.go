@@ -0,0 +1,220 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// drbdOption is a DRBD option that may be set through the drbdOptions volume
+// option, and the LINSTOR property it's stored in.
+type drbdOption struct {
+	prop  string
+	valid func(string) bool
+}
+
+func oneOf(values ...string) func(string) bool {
+	return func(v string) bool {
+		for _, s := range values {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func intBetween(min, max int) func(string) bool {
+	return func(v string) bool {
+		i, err := strconv.Atoi(v)
+		return err == nil && i >= min && i <= max
+	}
+}
+
+var rateRe = regexp.MustCompile(`^\d+[kMG]?$`)
+
+var drbdOptions = map[string]drbdOption{
+	"protocol": {"DrbdOptions/Net/protocol", oneOf("A", "B", "C")},
+	"quorum": {"DrbdOptions/Resource/quorum", func(v string) bool {
+		return oneOf("off", "majority", "all")(v) || intBetween(1, 32)(v)
+	}},
+	"on-no-quorum": {"DrbdOptions/Resource/on-no-quorum", oneOf("io-error", "suspend-io")},
+	"auto-promote": {"DrbdOptions/Resource/auto-promote", oneOf("yes", "no")},
+	"c-max-rate":   {"DrbdOptions/PeerDevice/c-max-rate", rateRe.MatchString},
+	"al-extents":   {"DrbdOptions/Disk/al-extents", intBetween(67, 65534)},
+}
+
+// parseDRBDOptions parses a list of name=value pairs, separated by spaces or
+// commas, into the LINSTOR properties they are stored in.
+func parseDRBDOptions(s string) (map[string]string, error) {
+	kv := map[string]string{}
+	for _, o := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		p := strings.SplitN(o, "=", 2)
+		if len(p) != 2 {
+			return nil, fmt.Errorf("drbdOptions must be name=value pairs, not %q", o)
+		}
+
+		opt, ok := drbdOptions[p[0]]
+		if !ok {
+			var names []string
+			for n := range drbdOptions {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unsupported DRBD option %q, supported are: %s", p[0], strings.Join(names, ", "))
+		}
+		if !opt.valid(p[1]) {
+			return nil, fmt.Errorf("invalid value %q for DRBD option %s", p[1], p[0])
+		}
+		kv[opt.prop] = p[1]
+	}
+	return kv, nil
+}
+
+// applyDRBDOptions sets the DRBD options on the resource definition, logging
+// options that drifted away from the requested values.
+func applyDRBDOptions(c linstorClient, def resDef, opts map[string]string) error {
+	changed := map[string]string{}
+	for k, v := range opts {
+		current := def.RscDfnProps.get(k)
+		if current == v {
+			continue
+		}
+		if current != "" {
+			log.Printf("resource %s: %s drifted to %q, resetting it to %q", def.RscName, k, current, v)
+		}
+		changed[k] = v
+	}
+	return c.setResourceDefinitionProps(def.RscName, changed)
+}
+
+// drbdDevices is the part of the output of drbdsetup status --json that maps
+// DRBD minors to resources and volumes.
+type drbdDevices []struct {
+	Name    string `json:"name"`
+	Devices []struct {
+		Volume int `json:"volume"`
+		Minor  int `json:"minor"`
+	} `json:"devices"`
+}
+
+// drbdVolumeOf maps a DRBD device on this node back to the resource and
+// volume it belongs to, by its minor. DRBD knows that locally, unlike the
+// controller, which may be out of reach when a volume has to be let go.
+func drbdVolumeOf(device string) (string, int, error) {
+	// LINSTOR may name devices by symlinks, the minor is in the name of
+	// the device they point to.
+	if p, err := filepath.EvalSymlinks(device); err == nil {
+		device = p
+	}
+	minor, err := strconv.Atoi(strings.TrimPrefix(device, "/dev/drbd"))
+	if err != nil {
+		return "", 0, fmt.Errorf("device %s is not a DRBD device", device)
+	}
+
+	out, err := run("drbdsetup", "status", "--json")
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to get DRBD status: %v: %s", err, out)
+	}
+	status := drbdDevices{}
+	if err := json.Unmarshal(out, &status); err != nil {
+		return "", 0, fmt.Errorf("couldn't Unmarshal %s :%v", out, err)
+	}
+	return status.volumeOf(minor, device)
+}
+
+// volumeOf returns the resource and volume of the DRBD minor.
+func (status drbdDevices) volumeOf(minor int, device string) (string, int, error) {
+	for _, r := range status {
+		for _, d := range r.Devices {
+			if d.Minor == minor {
+				return r.Name, d.Volume, nil
+			}
+		}
+	}
+	return "", 0, fmt.Errorf("device %s is not a volume of any DRBD resource on this node", device)
+}
+
+// upToDate returns the nodes with an UpToDate replica of a volume of resource
+// that node is connected to, including node itself, out of a resource list.
+// Only replicas on nodes whose satellite reports the resource count. Peers
+// count if the node's DRBD connection to them is established; satellites that
+// report no connections leave only the disk state to go by.
+func upToDate(res []resource, states []resourceState, resource string, volume int, node string) []string {
+	var conns drbdConnections
+	diskless := map[string]bool{}
+	for _, r := range res {
+		if r.Name != resource {
+			continue
+		}
+		diskless[r.NodeName] = r.diskless()
+		if r.NodeName == node {
+			conns = r.LayerObject.DRBD.Connections
+		}
+	}
+
+	nodes := []string{}
+	for _, st := range states {
+		if st.RscName != resource || !st.IsPresent || diskless[st.NodeName] {
+			continue
+		}
+		if st.NodeName != node && conns != nil && !conns[st.NodeName].Connected {
+			continue
+		}
+		for _, v := range st.VlmStates {
+			if v.VlmNr == volume && v.DiskState == "UpToDate" {
+				nodes = append(nodes, st.NodeName)
+			}
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// checkReplicaHealth refuses to go on if fewer replicas of the volume than
+// the minHealthyReplicas option asks for are UpToDate and connected to this
+// node, unless that is explicitly overridden.
+func checkReplicaHealth(c linstorClient, resource, node string, opts options) error {
+	if opts.minHealthyReplicas == 0 {
+		return nil
+	}
+
+	healthy, err := c.healthyReplicas(resource, opts.volumeNumber, node)
+	if err != nil {
+		return err
+	}
+	if len(healthy) >= opts.minHealthyReplicas {
+		return nil
+	}
+
+	msg := fmt.Sprintf("volume %d of resource %s has %d UpToDate and connected replicas (%s), minHealthyReplicas requires %d",
+		opts.volumeNumber, resource, len(healthy), strings.Join(healthy, ", "), opts.minHealthyReplicas)
+	if opts.ignoreReplicaHealth {
+		log.Printf("%s, mounting anyway as ignoreReplicaHealth is set", msg)
+		return nil
+	}
+	return fmt.Errorf("%s; refusing to mount it, set ignoreReplicaHealth to override", msg)
+}
@@ -0,0 +1,153 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseDRBDOptions(t *testing.T) {
+	var tableTests = []struct {
+		in    string
+		props map[string]string
+		ok    bool
+	}{
+		{"", map[string]string{}, true},
+		{"protocol=C", map[string]string{"DrbdOptions/Net/protocol": "C"}, true},
+		{"protocol=C,quorum=majority on-no-quorum=io-error", map[string]string{
+			"DrbdOptions/Net/protocol":          "C",
+			"DrbdOptions/Resource/quorum":       "majority",
+			"DrbdOptions/Resource/on-no-quorum": "io-error",
+		}, true},
+		{"quorum=2", map[string]string{"DrbdOptions/Resource/quorum": "2"}, true},
+		{"c-max-rate=100M,al-extents=6433", map[string]string{
+			"DrbdOptions/PeerDevice/c-max-rate": "100M",
+			"DrbdOptions/Disk/al-extents":       "6433",
+		}, true},
+		{"auto-promote=no,", map[string]string{"DrbdOptions/Resource/auto-promote": "no"}, true},
+		{"protocol", nil, false},
+		{"protocol=D", nil, false},
+		{"quorum=33", nil, false},
+		{"al-extents=66", nil, false},
+		{"c-max-rate=fast", nil, false},
+		{"verify-alg=crc32c", nil, false},
+	}
+
+	for _, tt := range tableTests {
+		props, err := parseDRBDOptions(tt.in)
+		if tt.ok && err != nil {
+			t.Errorf("Expected %q to parse, got %v", tt.in, err)
+			continue
+		}
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("Expected an error for %q, got %v", tt.in, props)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(props, tt.props) {
+			t.Errorf("Expected %v for %q, got %v", tt.props, tt.in, props)
+		}
+	}
+}
+
+func TestUpToDate(t *testing.T) {
+	out := []byte(`[{"resources":[
+ {"name":"r0","node_name":"n1","layer_object":{"drbd":{"connections":{
+  "n2":{"connected":true,"message":"Connected"},
+  "n3":{"connected":false,"message":"Connecting"},
+  "n4":{"connected":true,"message":"Connected"},
+  "n5":{"connected":true,"message":"Connected"},
+  "n6":{"connected":true,"message":"Connected"}}}}},
+ {"name":"r0","node_name":"n2"},
+ {"name":"r0","node_name":"n3"},
+ {"name":"r0","node_name":"n4","rsc_flags":["DISKLESS"]},
+ {"name":"r0","node_name":"n5"},
+ {"name":"r0","node_name":"n6"},
+ {"name":"r1","node_name":"n1","rsc_flags":["DISKLESS"]},
+ {"name":"r1","node_name":"n2"},
+ {"name":"r1","node_name":"n3"}],
+"resource_states":[
+ {"rsc_name":"r0","node_name":"n1","is_present":true,"vlm_states":[{"vlm_nr":0,"disk_state":"UpToDate"}]},
+ {"rsc_name":"r0","node_name":"n2","is_present":true,"vlm_states":[{"vlm_nr":0,"disk_state":"UpToDate"}]},
+ {"rsc_name":"r0","node_name":"n3","is_present":true,"vlm_states":[{"vlm_nr":0,"disk_state":"UpToDate"}]},
+ {"rsc_name":"r0","node_name":"n4","is_present":true,"vlm_states":[{"vlm_nr":0,"disk_state":"Diskless"}]},
+ {"rsc_name":"r0","node_name":"n5","is_present":true,"vlm_states":[{"vlm_nr":0,"disk_state":"Inconsistent"}]},
+ {"rsc_name":"r0","node_name":"n6","is_present":false,"vlm_states":[{"vlm_nr":0,"disk_state":"UpToDate"}]},
+ {"rsc_name":"r1","node_name":"n1","is_present":true,"vlm_states":[{"vlm_nr":0,"disk_state":"Diskless"}]},
+ {"rsc_name":"r1","node_name":"n2","is_present":true,"vlm_states":[{"vlm_nr":0,"disk_state":"UpToDate"},{"vlm_nr":1,"disk_state":"Outdated"}]},
+ {"rsc_name":"r1","node_name":"n3","is_present":true,"vlm_states":[{"vlm_nr":0,"disk_state":"UpToDate"}]}]}]`)
+	list := resList{}
+	if err := json.Unmarshal(out, &list); err != nil {
+		t.Fatalf("Expected the resource list to parse, got %v", err)
+	}
+	res, states := list[0].Resources, list[0].ResourceStates
+
+	var tableTests = []struct {
+		resource string
+		volume   int
+		node     string
+		nodes    []string
+	}{
+		{"r0", 0, "n1", []string{"n1", "n2"}},
+		{"r0", 1, "n1", []string{}},
+		// Without connections reported, the disk state is all there is.
+		{"r0", 0, "n2", []string{"n1", "n2", "n3"}},
+		{"r1", 0, "n1", []string{"n2", "n3"}},
+		{"r1", 1, "n1", []string{}},
+		{"r2", 0, "n1", []string{}},
+	}
+
+	for _, tt := range tableTests {
+		nodes := upToDate(res, states, tt.resource, tt.volume, tt.node)
+		if !reflect.DeepEqual(nodes, tt.nodes) {
+			t.Errorf("Expected %v for volume %d of %s on %s, got %v", tt.nodes, tt.volume, tt.resource, tt.node, nodes)
+		}
+	}
+}
+
+func TestDRBDDevicesVolumeOf(t *testing.T) {
+	out := []byte(`[{"name":"r0","devices":[{"volume":0,"minor":1000},{"volume":1,"minor":1001}]},
+{"name":"r1","devices":[{"volume":0,"minor":1002}]}]`)
+	status := drbdDevices{}
+	if err := json.Unmarshal(out, &status); err != nil {
+		t.Fatalf("Expected status to parse, got %v", err)
+	}
+
+	var tableTests = []struct {
+		minor    int
+		resource string
+		volume   int
+		ok       bool
+	}{
+		{1000, "r0", 0, true},
+		{1001, "r0", 1, true},
+		{1002, "r1", 0, true},
+		{1003, "", 0, false},
+	}
+
+	for _, tt := range tableTests {
+		resource, volume, err := status.volumeOf(tt.minor, "/dev/drbd")
+		if (err == nil) != tt.ok || resource != tt.resource || volume != tt.volume {
+			t.Errorf("Expected %s/%d (ok %t) for minor %d, got %s/%d (%v)", tt.resource, tt.volume, tt.ok, tt.minor, resource, volume, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const dryRunEnv = "LINSTOR_FLEXVOLUME_DRY_RUN"
+
+// In dry run mode, commands that change anything are recorded in the plan
+// instead of run. Queries still run, so the plan is made against the actual
+// state of the node and LINSTOR.
+var (
+	dryRun bool
+	plan   []string
+)
+
+// dryRunEnabled reports whether the environment or the node config ask for
+// a dry run.
+func dryRunEnabled() bool {
+	if v, err := strconv.ParseBool(os.Getenv(dryRunEnv)); err == nil {
+		return v
+	}
+	cfg, err := loadNodeConfig()
+	return err == nil && cfg.DryRun
+}
+
+// planned records the command in the plan and returns true in dry run mode.
+func planned(name string, args ...string) bool {
+	if !dryRun {
+		return false
+	}
+	cmd := strings.Join(append([]string{name}, redact(args)...), " ")
+	log.Printf("dry run, not running: %s", cmd)
+	plan = append(plan, cmd)
+	return true
+}
+
+// change runs a command that changes something, unless in dry run mode.
+func change(name string, args ...string) ([]byte, error) {
+	if planned(name, args...) {
+		return nil, nil
+	}
+	return run(name, args...)
+}
+
+// planStops answers successfully if err is only because the planned changes
+// were not made, the rest of the call can't be planned then.
+func (api FlexVolumeApi) planStops(err error) (string, bool) {
+	if err == nil || !dryRun || len(plan) == 0 {
+		return "", false
+	}
+	res, _ := json.Marshal(response{
+		Status:  "Success",
+		Message: fmt.Sprintf("dry run of %s stopped at %s, it depends on the planned changes: %v", api.action, currentStep, err),
+	})
+	return string(res), true
+}
+
+// withPlan adds the plan to a JSON response.
+func withPlan(out string) string {
+	res := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		return out
+	}
+	res["dryRun"] = true
+	res["plan"] = append([]string{}, plan...)
+	b, err := json.Marshal(res)
+	if err != nil {
+		return out
+	}
+	return string(b)
+}
@@ -0,0 +1,165 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Kubelet passes the flexvolume secret as options with this prefix, with
+// base64 encoded values.
+const secretPrefix = "kubernetes.io/secret/"
+
+const redacted = "<redacted>"
+
+// secrets holds values that must never show up in the log.
+var secrets []string
+
+func addSecret(s string) {
+	if s != "" {
+		secrets = append(secrets, s)
+	}
+}
+
+// redact replaces secrets in args for logging.
+func redact(args []string) []string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		out[i] = a
+		for _, s := range secrets {
+			out[i] = strings.Replace(out[i], s, redacted, -1)
+		}
+	}
+	return out
+}
+
+// RedactArgs returns the driver call args with the values of secret options
+// replaced, so they can be logged.
+func RedactArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		out[i] = redactOptions(a)
+	}
+	return out
+}
+
+func redactOptions(s string) string {
+	opts := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(s), &opts); err != nil {
+		return s
+	}
+	found := false
+	for k := range opts {
+		if strings.HasPrefix(k, secretPrefix) {
+			opts[k] = redacted
+			found = true
+		}
+	}
+	if !found {
+		return s
+	}
+	// Without escaping, the log shows <redacted> rather than \u003credacted\u003e.
+	res := &strings.Builder{}
+	enc := json.NewEncoder(res)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(opts); err != nil {
+		return redacted
+	}
+	return strings.TrimSuffix(res.String(), "\n")
+}
+
+func decodeSecret(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("couldn't decode secret: %v", err)
+	}
+	return string(b), nil
+}
+
+// encrypted reports whether any volume of the resource definition is encrypted.
+func (def resDef) encrypted() bool {
+	for _, v := range def.VlmDfns {
+		for _, f := range v.VlmDfnFlags {
+			if f == "ENCRYPTED" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unlockEncryption enters the master passphrase on the controller if the
+// volume is, or is going to be, encrypted. The controller forgets the
+// passphrase when it restarts, and LINSTOR has no call to ask whether it was
+// entered, so it is entered on every attach. An encrypted volume without a
+// passphrase in the volume secret is an error, even if the controller may
+// still have it from an earlier attach.
+func unlockEncryption(c linstorClient, opts options, node string) error {
+	needed := opts.encryptVolumes
+	if !needed {
+		defs, err := c.resourceDefinitions()
+		if err != nil {
+			return err
+		}
+		for _, def := range defs {
+			if def.RscName == opts.getResource(node) {
+				needed = def.encrypted()
+			}
+		}
+	}
+	if !needed {
+		return nil
+	}
+
+	if opts.passphrase == "" {
+		return apiError{codeInvalidOptions, fmt.Errorf("resource %s is encrypted, but no passphrase was passed in the volume secret",
+			opts.getResource(node))}
+	}
+
+	// Passed on standard input, the client prompts for it if it is not
+	// given as argument, where everybody on the node could read it.
+	if err := c.withInput(opts.passphrase+"\n").doChecked(passphraseEntered, "encryption", "enter-passphrase"); err != nil {
+		return fmt.Errorf("unable to enter the encryption passphrase on the controller: %v", err)
+	}
+	return nil
+}
+
+// passphraseEntered validates the answer to entering the passphrase, taking
+// the controller telling that it has it already for success.
+func passphraseEntered(s returnStatuses) error {
+	err := s.validate()
+	if err == nil {
+		return nil
+	}
+	if code, ok := s.failure(); ok && retCodeIn(code, failExists) {
+		return nil
+	}
+	for _, st := range s {
+		if st.RetCode&maskError == maskError && !strings.Contains(strings.ToLower(st.MessageFormat), "already") {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import "testing"
+
+func TestPassphraseEntered(t *testing.T) {
+	var tableTests = []struct {
+		code  uint64
+		msg   string
+		valid bool
+	}{
+		{0, "Passphrase accepted", true},
+		{maskError | 0x1000000 | 501, "Passphrase was already entered", true},
+		{maskError | 0x1000000 | 1000, "Master passphrase already set", true},
+		{maskError | 0x1000000 | 110, "Invalid passphrase", false},
+		{maskError | 0x1000000 | 1000, "Passphrase not accepted", false},
+	}
+
+	for _, tt := range tableTests {
+		s := returnStatuses{{MessageFormat: tt.msg, RetCode: tt.code}}
+		if err := passphraseEntered(s); (err == nil) != tt.valid {
+			t.Errorf("Expected valid %t for %q, got error %v", tt.valid, tt.msg, err)
+		}
+	}
+}
+
+func TestRedactOptions(t *testing.T) {
+	var tableTests = []struct {
+		in       string
+		expected string
+	}{
+		{`{"kubernetes.io/secret/passphrase":"c2VjcmV0","resource":"r0"}`,
+			`{"kubernetes.io/secret/passphrase":"<redacted>","resource":"r0"}`},
+		{`{"kubernetes.io/secret/a":"eA==","kubernetes.io/secret/b":"eQ=="}`,
+			`{"kubernetes.io/secret/a":"<redacted>","kubernetes.io/secret/b":"<redacted>"}`},
+		// Untouched unless there is something to redact.
+		{`{"resource": "r0"}`, `{"resource": "r0"}`},
+		{"/var/lib/kubelet/pods/uid", "/var/lib/kubelet/pods/uid"},
+		{"", ""},
+	}
+
+	for _, tt := range tableTests {
+		if out := redactOptions(tt.in); out != tt.expected {
+			t.Errorf("Expected %s for %s, got %s", tt.expected, tt.in, out)
+		}
+	}
+
+	args := RedactArgs([]string{"attach", `{"kubernetes.io/secret/passphrase":"c2VjcmV0"}`, "n1"})
+	if args[0] != "attach" || args[1] != `{"kubernetes.io/secret/passphrase":"<redacted>"}` || args[2] != "n1" {
+		t.Errorf("Expected the passphrase redacted from the args, got %v", args)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	defer func(s []string) { secrets = s }(secrets)
+	secrets = nil
+	addSecret("")
+	addSecret("hunter2")
+
+	out := redact([]string{"--passphrase", "hunter2", "x=hunter2hunter2", "none"})
+	expected := []string{"--passphrase", "<redacted>", "x=<redacted><redacted>", "none"}
+	for i := range expected {
+		if out[i] != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], out[i])
+		}
+	}
+}
@@ -0,0 +1,273 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	linstor "github.com/LINBIT/golinstor"
+)
+
+// Ephemeral resources are tagged with these properties when they are created.
+const (
+	ephemeralProp         = auxPrefix + "ephemeral"
+	ephemeralNodeProp     = auxPrefix + "ephemeral-node"
+	ephemeralVolumeProp   = auxPrefix + "ephemeral-volume"
+	ephemeralGraceProp    = auxPrefix + "ephemeral-grace-period"
+	ephemeralCreatedProp  = auxPrefix + "ephemeral-created"
+	ephemeralDetachedProp = auxPrefix + "ephemeral-detached"
+	ephemeralPodProp      = auxPrefix + "ephemeral-pod"
+)
+
+// Ephemeral resources that were never attached are only considered orphaned
+// after this long, so cleanup does not race with an attach in progress.
+const ephemeralOrphanAge = 10 * time.Minute
+
+// ephemeralName returns the name of the ephemeral resource for volume on node.
+// Kubelet passes the same volume name to every call for the volume, so the
+// name can be derived from it instead of being stored anywhere. Kubelet
+// doesn't pass the pod to attach, and attaches an inline volume only once per
+// node and volume name, so the pod can't be part of the name. The pod is
+// recorded by mount instead, see claimEphemeral.
+func ephemeralName(volume, node string) string {
+	sum := sha256.Sum256([]byte(node + "/" + volume))
+	return fmt.Sprintf("ephemeral-%x", sum[:8])
+}
+
+// ephemeralResource returns the ephemeral resource definition for volume on
+// node, or nil if the volume isn't ephemeral.
+func (c linstorClient) ephemeralResource(volume, node string) (*resDef, error) {
+	name := ephemeralName(volume, node)
+
+	defs, err := c.resourceDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	for _, def := range defs {
+		if def.RscName == name && def.RscDfnProps.get(ephemeralProp) == "true" {
+			return &def, nil
+		}
+	}
+	return nil, nil
+}
+
+// claimEphemeral records pod as the one using the ephemeral resource. Inline
+// volumes of the same name in several pods on a node would share the
+// resource, so it is refused to a pod while the pod recorded for it is still
+// on the node. Once that pod is gone, which only happens within the grace
+// period, the resource is handed to the new one.
+func claimEphemeral(c linstorClient, cfg nodeConfig, resource, pod string) error {
+	def, err := c.resourceDefinition(resource)
+	if err != nil {
+		return err
+	}
+	owner := def.RscDfnProps.get(ephemeralPodProp)
+	if owner == pod {
+		return nil
+	}
+	if owner != "" {
+		if _, err := os.Stat(filepath.Join(cfg.KubeletDir, "pods", owner)); err == nil {
+			return apiError{codeVolumeInUse, fmt.Errorf("ephemeral resource %s is used by pod %s on this node, "+
+				"pods on a node can't share inline volumes of the same name", resource, owner)}
+		}
+		log.Printf("ephemeral resource %s was used by pod %s, which is gone, handing it to pod %s", resource, owner, pod)
+	}
+	return c.setResourceDefinitionProps(resource, map[string]string{ephemeralPodProp: pod})
+}
+
+// releaseEphemeral is called when an ephemeral resource is detached from the
+// node it was created for. Without a grace period the resource is deleted
+// right away, otherwise it's marked as detached for cleanup to delete it
+// once the grace period is over.
+func releaseEphemeral(c linstorClient, r linstor.ResourceDeployment, def resDef, node string) error {
+	grace, err := time.ParseDuration(def.RscDfnProps.get(ephemeralGraceProp))
+	if err != nil {
+		grace = 0
+	}
+
+	if grace == 0 {
+		log.Printf("deleting ephemeral resource %s", r.Name)
+		return deleteResource(c, r)
+	}
+
+	client, err := c.isClient(r.Name, node)
+	if err != nil {
+		return err
+	}
+	if client {
+		if err := unassign(c, r, node); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("ephemeral resource %s detached, deleting it after %s", r.Name, grace)
+	return c.setResourceDefinitionProps(r.Name, map[string]string{
+		ephemeralDetachedProp: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+type ephemeralInfo struct {
+	Resource    string `json:"resource"`
+	Volume      string `json:"volume"`
+	Node        string `json:"node"`
+	Pod         string `json:"pod,omitempty"`
+	GracePeriod string `json:"gracePeriod"`
+	Detached    string `json:"detached,omitempty"`
+	State       string `json:"state"`
+	Deleted     bool   `json:"deleted"`
+	Error       string `json:"error,omitempty"`
+}
+
+type ephemeralResponse struct {
+	response
+	Resources []ephemeralInfo `json:"resources"`
+}
+
+// ephemeralCmd lists ephemeral resources and recovers the orphaned ones:
+// resources whose grace period after detach is over, and resources that
+// were created but never got attached to their node.
+func (api FlexVolumeApi) ephemeralCmd(args []string) (string, int) {
+	const usage = "ephemeral [-o table|json] [-controllers <controllers>] list | cleanup [-apply]"
+
+	flags := api.newFlagSet()
+	output := outputFlag(flags)
+	controllers := flags.String("controllers", "", "LINSTOR controllers, overrides the node config")
+	apply := flags.Bool("apply", false, "delete the resources cleanup would delete")
+	if err := flags.Parse(args); err != nil {
+		return api.fmtAPIError(err)
+	}
+	if flags.NArg() < 1 {
+		return api.fmtAPIError(fmt.Errorf("usage: %s", usage))
+	}
+	cmd := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return api.fmtAPIError(err)
+	}
+	if err := checkOutputFormat(*output); err != nil {
+		return api.fmtAPIError(err)
+	}
+	if cmd != "list" && cmd != "cleanup" {
+		return api.fmtAPIError(fmt.Errorf("usage: %s", usage))
+	}
+
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	c := adminClient(cfg, *controllers)
+
+	defs, err := c.resourceDefinitions()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	resources, err := c.resources()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	resp := ephemeralResponse{
+		response:  response{Status: "Success"},
+		Resources: []ephemeralInfo{},
+	}
+	ret := EXITSUCCESS
+
+	for _, def := range defs {
+		if def.RscDfnProps.get(ephemeralProp) != "true" {
+			continue
+		}
+
+		info := newEphemeralInfo(def, resources)
+
+		if cmd == "cleanup" && *apply && (info.State == "expired" || info.State == "orphaned") {
+			r := linstor.NewResourceDeployment(linstor.ResourceDeploymentConfig{
+				Name:        def.RscName,
+				Controllers: c.controllers,
+				LogOut:      logOutput,
+			})
+			log.Printf("deleting %s ephemeral resource %s", info.State, def.RscName)
+			if err := deleteResource(c, r); err != nil {
+				info.Error = err.Error()
+				resp.Status = "Failure"
+				ret = EXITDRBDFAILURE
+			} else {
+				info.Deleted = true
+			}
+		}
+
+		resp.Resources = append(resp.Resources, info)
+	}
+
+	if *output == "json" {
+		res, _ := json.Marshal(resp)
+		return string(res), ret
+	}
+
+	rows := [][]string{}
+	for _, i := range resp.Resources {
+		state := i.State
+		if i.Deleted {
+			state += ", deleted"
+		}
+		if i.Error != "" {
+			state += ", " + i.Error
+		}
+		rows = append(rows, []string{i.Resource, i.Volume, i.Node, i.Pod, i.GracePeriod, i.Detached, state})
+	}
+	return formatTable([]string{"RESOURCE", "VOLUME", "NODE", "POD", "GRACE", "DETACHED", "STATE"}, rows), ret
+}
+
+func newEphemeralInfo(def resDef, resources []resource) ephemeralInfo {
+	p := def.RscDfnProps
+	info := ephemeralInfo{
+		Resource:    def.RscName,
+		Volume:      p.get(ephemeralVolumeProp),
+		Node:        p.get(ephemeralNodeProp),
+		Pod:         p.get(ephemeralPodProp),
+		GracePeriod: p.get(ephemeralGraceProp),
+		Detached:    p.get(ephemeralDetachedProp),
+		State:       "attached",
+	}
+
+	if info.Detached != "" {
+		info.State = "detached"
+		detached, err := time.Parse(time.RFC3339, info.Detached)
+		grace, gerr := time.ParseDuration(info.GracePeriod)
+		if err != nil || gerr != nil || time.Since(detached) >= grace {
+			info.State = "expired"
+		}
+		return info
+	}
+
+	for _, r := range resources {
+		if r.Name == def.RscName && r.NodeName == info.Node {
+			return info
+		}
+	}
+	created, err := time.Parse(time.RFC3339, p.get(ephemeralCreatedProp))
+	if err != nil || time.Since(created) >= ephemeralOrphanAge {
+		info.State = "orphaned"
+	}
+	return info
+}
@@ -0,0 +1,158 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"errors"
+	"strings"
+)
+
+// errorCode is a stable, machine readable reason for a failed call. The codes
+// are part of the driver's interface, only ever add to them.
+type errorCode string
+
+const (
+	codeUnknown               errorCode = "Unknown"
+	codeInvalidArguments      errorCode = "InvalidArguments"
+	codeInvalidOptions        errorCode = "InvalidOptions"
+	codeUnsupported           errorCode = "Unsupported"
+	codeControllerUnavailable errorCode = "ControllerUnavailable"
+	codeNotFound              errorCode = "NotFound"
+	codeNoSpace               errorCode = "NoSpace"
+	codePlacementFailed       errorCode = "PlacementFailed"
+	codeProvisionFailed       errorCode = "ProvisionFailed"
+	codeAssignFailed          errorCode = "AssignFailed"
+	codeUnassignFailed        errorCode = "UnassignFailed"
+	codeLocalityFailed        errorCode = "LocalityFailed"
+	codeDeviceNotFound        errorCode = "DeviceNotFound"
+	codeReplicasUnhealthy     errorCode = "ReplicasUnhealthy"
+	codeWrongFilesystem       errorCode = "WrongFilesystem"
+	codeDeviceNotBlank        errorCode = "DeviceNotBlank"
+	codeFormatFailed          errorCode = "FormatFailed"
+	codeMountFailed           errorCode = "MountFailed"
+	codeUnmountFailed         errorCode = "UnmountFailed"
+	codeGrowFailed            errorCode = "GrowFailed"
+	codeEncryptionFailed      errorCode = "EncryptionFailed"
+	codeTLSFailed             errorCode = "TLSFailed"
+	codeVolumeInUse           errorCode = "VolumeInUse"
+)
+
+// API status codes beyond the original ones, used as exit codes in main.
+const (
+	EXITCONTROLLERUNAVAILABLE int = iota + EXITBADAPICALL + 1
+	EXITNOSPACE
+	EXITNOTFOUND
+	EXITFILESYSTEMFAILURE
+	EXITENCRYPTIONFAILURE
+	EXITTLSFAILURE
+)
+
+// Every code exits with one of the API status codes.
+var exitCodes = map[errorCode]int{
+	codeUnknown:               EXITBADAPICALL,
+	codeInvalidArguments:      EXITBADAPICALL,
+	codeInvalidOptions:        EXITBADAPICALL,
+	codeUnsupported:           EXITBADAPICALL,
+	codeControllerUnavailable: EXITCONTROLLERUNAVAILABLE,
+	codeNotFound:              EXITNOTFOUND,
+	codeNoSpace:               EXITNOSPACE,
+	codePlacementFailed:       EXITDRBDFAILURE,
+	codeProvisionFailed:       EXITDRBDFAILURE,
+	codeAssignFailed:          EXITDRBDFAILURE,
+	codeUnassignFailed:        EXITDRBDFAILURE,
+	codeLocalityFailed:        EXITDRBDFAILURE,
+	codeDeviceNotFound:        EXITDRBDFAILURE,
+	codeReplicasUnhealthy:     EXITDRBDFAILURE,
+	codeWrongFilesystem:       EXITFILESYSTEMFAILURE,
+	codeDeviceNotBlank:        EXITFILESYSTEMFAILURE,
+	codeFormatFailed:          EXITFILESYSTEMFAILURE,
+	codeMountFailed:           EXITFILESYSTEMFAILURE,
+	codeUnmountFailed:         EXITFILESYSTEMFAILURE,
+	codeGrowFailed:            EXITFILESYSTEMFAILURE,
+	codeEncryptionFailed:      EXITENCRYPTIONFAILURE,
+	codeTLSFailed:             EXITTLSFAILURE,
+	codeVolumeInUse:           EXITBADAPICALL,
+}
+
+// What the running call works on, reported along with its errors.
+var (
+	currentResource string
+	currentNode     string
+)
+
+// target records the resource and node the running call works on.
+func target(resource, node string) {
+	currentResource, currentNode = resource, node
+}
+
+// apiError is an error with a code.
+type apiError struct {
+	code errorCode
+	err  error
+}
+
+func (e apiError) Error() string {
+	return e.err.Error()
+}
+
+func (e apiError) Unwrap() error {
+	return e.err
+}
+
+// withCode gives err the code, unless a more specific one is known: either
+// it has a code already, or it tells that LINSTOR could not be reached or
+// lacks something.
+func withCode(code errorCode, err error) error {
+	if err == nil || errorCodeOf(err) != codeUnknown {
+		return err
+	}
+	return apiError{code: code, err: err}
+}
+
+// errorCodeOf returns the code of err. Errors without one, from golinstor
+// or the linstor client, are sorted by their LINSTOR return code if they
+// carry one, or else by what they say.
+func errorCodeOf(err error) errorCode {
+	var e apiError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	if code, ok := retCodeOf(err); ok {
+		switch {
+		case retCodeIn(code, failNotFound):
+			return codeNotFound
+		case retCodeIn(code, failInvalid):
+			return codeInvalidOptions
+		case code == failStorPoolConfiguration || code == failNotEnoughNodes:
+			return codeNoSpace
+		}
+		return codeUnknown
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case transient(err):
+		return codeControllerUnavailable
+	case strings.Contains(msg, "not found") || strings.Contains(msg, "not exist"):
+		return codeNotFound
+	case strings.Contains(msg, "no space") || strings.Contains(msg, "not enough free space"):
+		return codeNoSpace
+	}
+	return codeUnknown
+}
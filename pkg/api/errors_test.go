@@ -0,0 +1,88 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	status := func(code uint64, msg string) error {
+		s := returnStatuses{{MessageFormat: msg, RetCode: code}}
+		return fmt.Errorf("unable to set property: %v", s.validate())
+	}
+
+	var tableTests = []struct {
+		err       error
+		transient bool
+		code      errorCode
+	}{
+		{status(maskError|0x140000|305, "Resource definition 'r0' not found."), false, codeNotFound},
+		{status(maskError|0x140000|501, "Resource definition 'r0' already exists."), false, codeUnknown},
+		{status(maskError|0x4000000|1001, "Operation timed out, controller is not connected."), false, codeUnknown},
+		{status(maskError|0x140000|104, "The specified resource name 'r 0' is invalid."), false, codeInvalidOptions},
+		{status(maskError|0x4000000|1002, "Storage pool 'thin' on node 'n1' is not configured."), false, codeNoSpace},
+		{status(maskError|0x4000000|1006, "Not enough available nodes"), false, codeNoSpace},
+		{status(maskError|0x4000000|1006, "Resource definition 'r0' not found."), false, codeNoSpace},
+		{status(maskError|0x140000|305, "Not enough free space."), false, codeNotFound},
+		{errors.New("exit status 20: Error: Unable connecting to linstor://ctrl:3370: [Errno 111] Connection refused"), true, codeControllerUnavailable},
+		{errors.New("exit status 20: read timed out"), true, codeControllerUnavailable},
+		{errors.New("resource definition r0 not found"), false, codeNotFound},
+		{errors.New("something else"), false, codeUnknown},
+	}
+
+	for _, tt := range tableTests {
+		if transient(tt.err) != tt.transient {
+			t.Errorf("Expected transient %t for %q, got %t", tt.transient, tt.err, !tt.transient)
+		}
+		if code := errorCodeOf(tt.err); code != tt.code {
+			t.Errorf("Expected code %s for %q, got %s", tt.code, tt.err, code)
+		}
+	}
+}
+
+func TestRetryMutation(t *testing.T) {
+	retryDeadline = time.Now().Add(time.Minute)
+	defer func() { retryDeadline = time.Time{} }()
+
+	var tableTests = []struct {
+		err   error
+		calls int
+	}{
+		{errors.New("exit status 20: read timed out"), 1},
+		{errors.New("exit status 20: Connection refused"), 2},
+	}
+
+	for _, tt := range tableTests {
+		calls := 0
+		retryMutation("test", func() error {
+			calls++
+			if calls > 1 {
+				return nil
+			}
+			return tt.err
+		})
+		if calls != tt.calls {
+			t.Errorf("Expected %d calls after %q, got %d", tt.calls, tt.err, calls)
+		}
+	}
+}
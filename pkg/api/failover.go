@@ -0,0 +1,217 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// With several controllers configured, the driver asks them one at a time,
+// in order, and moves on to the next if one can't be reached. The one that
+// answered last is remembered on the node for a while and asked first, so
+// calls don't wait for a dead controller to time out every time.
+
+const (
+	defaultStateDir      = "/run/linstor-flexvolume"
+	defaultControllerTTL = 5 * time.Minute
+	controllerStateFile  = "controller.json"
+)
+
+// The controller that served the running call's last request, and the one
+// it recorded to be asked first.
+var servingController, rememberedController string
+
+type controllerState struct {
+	Controllers string    `json:"controllers"`
+	Controller  string    `json:"controller"`
+	Time        time.Time `json:"time"`
+}
+
+func controllerStatePath(cfg nodeConfig) string {
+	return filepath.Join(cfg.StateDir, controllerStateFile)
+}
+
+func controllerTTL(cfg nodeConfig) time.Duration {
+	if cfg.ControllerTTL == "" {
+		return defaultControllerTTL
+	}
+	d, err := time.ParseDuration(cfg.ControllerTTL)
+	if err != nil {
+		log.Printf("ignoring controllerTTL %q: %v", cfg.ControllerTTL, err)
+		return defaultControllerTTL
+	}
+	return d
+}
+
+func splitControllers(controllers string) []string {
+	var list []string
+	for _, c := range strings.Split(controllers, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// controllerOrder returns the controllers to try, the one remembered first.
+func controllerOrder(controllers string) []string {
+	list := splitControllers(controllers)
+	if len(list) < 2 {
+		return list
+	}
+
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return list
+	}
+	data, err := ioutil.ReadFile(controllerStatePath(cfg))
+	if err != nil {
+		return list
+	}
+	st := controllerState{}
+	if json.Unmarshal(data, &st) != nil || st.Controllers != controllers ||
+		time.Since(st.Time) > controllerTTL(cfg) {
+		return list
+	}
+
+	order := []string{st.Controller}
+	for _, c := range list {
+		if c != st.Controller {
+			order = append(order, c)
+		}
+	}
+	if len(order) != len(list) {
+		// The remembered controller is not in the list anymore.
+		return list
+	}
+	return order
+}
+
+// rememberController records that controller answered, once per call. A
+// remembered controller is asked first until its TTL runs out without it
+// answering any call, then the order of the list counts again.
+func rememberController(controllers, controller string, order []string) {
+	servingController = controller
+	if len(order) < 2 || controller == rememberedController {
+		return
+	}
+
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return
+	}
+	data, _ := json.Marshal(controllerState{Controllers: controllers, Controller: controller, Time: time.Now()})
+	if err = os.MkdirAll(cfg.StateDir, 0755); err == nil {
+		err = writeFileAtomic(controllerStatePath(cfg), data, 0644)
+	}
+	if err != nil {
+		log.Printf("couldn't remember controller %s: %v", controller, err)
+		return
+	}
+	rememberedController = controller
+}
+
+// pinController returns the controller that served the running call, if it
+// is one of controllers, for golinstor, which can't fail over by itself.
+func pinController(controllers string) string {
+	for _, c := range splitControllers(controllers) {
+		if c == servingController {
+			return c
+		}
+	}
+	return controllers
+}
+
+// runLinstor runs the linstor client against the controllers in order, until
+// one can be reached.
+func (c linstorClient) runLinstor(args ...string) ([]byte, error) {
+	order := controllerOrder(c.tlsControllers())
+	if len(order) < 2 {
+		if len(order) == 1 && c.tls.enabled() {
+			if err := checkTLS(c.tls, order[0]); err != nil {
+				return nil, err
+			}
+		}
+		out, err := runInput(c.input, "linstor", c.args(args...)...)
+		if err == nil && c.controllers != "" {
+			servingController = c.controllers
+		}
+		return out, err
+	}
+
+	var out []byte
+	var err error
+	for _, ctrl := range order {
+		if c.tls.enabled() {
+			if err = checkTLS(c.tls, ctrl); err != nil && unreachable(err) {
+				log.Printf("controller %s can't be reached, trying the next one", ctrl)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		out, err = runInput(c.input, "linstor", linstorClient{controllers: ctrl, tls: c.tls}.args(args...)...)
+		if err != nil && unreachable(fmt.Errorf("%v: %s", err, out)) {
+			log.Printf("controller %s can't be reached, trying the next one", ctrl)
+			continue
+		}
+		rememberController(c.controllers, ctrl, order)
+		return out, err
+	}
+	return out, err
+}
+
+// Failures to connect or to resolve the controller's name, as the linstor
+// client and Go put them.
+var unreachableErrors = []string{
+	"connection refused",
+	"unable to connect",
+	"unable connecting to",
+	"no route to host",
+	"network is unreachable",
+	"name or service not known",
+	"temporary failure in name resolution",
+	"no such host",
+}
+
+// unreachable tells if err means the request never got to the controller,
+// so that it is safe to send it to another one, or again.
+func unreachable(err error) bool {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	if errors.As(err, &dnsErr) || (errors.As(err, &opErr) && opErr.Op == "dial") {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range unreachableErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestUnreachable(t *testing.T) {
+	var tableTests = []struct {
+		err         error
+		unreachable bool
+	}{
+		{errors.New("exit status 20: Error: Unable connecting to linstor://ctrl:3370: [Errno 111] Connection refused"), true},
+		{errors.New("exit status 20: Error: Unable connecting to linstor://ctrl:3370: timed out"), true},
+		{errors.New("exit status 20: Error: Unable connecting to linstor://ctrl:3370: [Errno -2] Name or service not known"), true},
+		{errors.New("exit status 20: [Errno -3] Temporary failure in name resolution"), true},
+		{errors.New("exit status 20: No route to host"), true},
+		{&net.DNSError{Err: "no such host", Name: "ctrl"}, true},
+		{fmt.Errorf("checking TLS: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("i/o timeout")}), true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("i/o timeout")}, false},
+		{errors.New("exit status 20: read timed out"), false},
+		{errors.New("exit status 20: Connection reset by peer"), false},
+	}
+
+	for _, tt := range tableTests {
+		if unreachable(tt.err) != tt.unreachable {
+			t.Errorf("Expected unreachable %t for %q, got %t", tt.unreachable, tt.err, !tt.unreachable)
+		}
+	}
+}
@@ -0,0 +1,608 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	linstor "github.com/LINBIT/golinstor"
+)
+
+// Devices are only grown if they are at least this much larger than the
+// filesystem on them, filesystems do not always end exactly on the last
+// byte of the device.
+const minGrowBytes = 1 << 20
+
+// run executes an external command and returns its combined output, tracing
+// the call the same way golinstor does.
+func run(name string, args ...string) ([]byte, error) {
+	return runInput("", name, args...)
+}
+
+// runInput is run, with input fed to the command's standard input. The
+// command gets a session of its own, without a controlling terminal, so
+// that prompts read input instead of asking on a terminal.
+func runInput(input, name string, args ...string) ([]byte, error) {
+	log.Printf("%s %s", name, strings.Join(redact(args), " "))
+	cmd := exec.Command(name, args...)
+	start := time.Now()
+	if input == "" {
+		out, err := cmd.CombinedOutput()
+		timeCommand(name, time.Since(start))
+		return out, err
+	}
+
+	// Prompts go to standard error, keep them out of the output unless
+	// the command fails.
+	stderr := &bytes.Buffer{}
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stderr = stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	out, err := cmd.Output()
+	timeCommand(name, time.Since(start))
+	if err != nil {
+		out = append(out, stderr.Bytes()...)
+	}
+	return out, err
+}
+
+// blockDeviceSize returns the size of the block device in bytes.
+func blockDeviceSize(device string) (int64, error) {
+	out, err := run("blockdev", "--getsize64", device)
+	if err != nil {
+		return 0, fmt.Errorf("unable to determine size of %s: %v: %s", device, err, out)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+var (
+	xfsDataRe    = regexp.MustCompile(`(?m)^data\s+=\s+bsize=(\d+)\s+blocks=(\d+)`)
+	extBlockCnt  = regexp.MustCompile(`(?m)^Block count:\s+(\d+)`)
+	extBlockSize = regexp.MustCompile(`(?m)^Block size:\s+(\d+)`)
+)
+
+// fsSize returns the size of the filesystem on device, mounted at path, in bytes.
+func fsSize(device, path, fsType string) (int64, error) {
+	var bsize, blocks string
+
+	switch fsType {
+	case "xfs":
+		out, err := run("xfs_info", path)
+		if err != nil {
+			return 0, fmt.Errorf("unable to query xfs filesystem on %s: %v: %s", path, err, out)
+		}
+		m := xfsDataRe.FindSubmatch(out)
+		if m == nil {
+			return 0, fmt.Errorf("couldn't parse data section from xfs_info output %s", out)
+		}
+		bsize, blocks = string(m[1]), string(m[2])
+	case "ext2", "ext3", "ext4":
+		out, err := run("dumpe2fs", "-h", device)
+		if err != nil {
+			return 0, fmt.Errorf("unable to query %s filesystem on %s: %v: %s", fsType, device, err, out)
+		}
+		c, s := extBlockCnt.FindSubmatch(out), extBlockSize.FindSubmatch(out)
+		if c == nil || s == nil {
+			return 0, fmt.Errorf("couldn't parse block count and size from dumpe2fs output %s", out)
+		}
+		bsize, blocks = string(s[1]), string(c[1])
+	default:
+		return 0, fmt.Errorf("unable to determine size of %q filesystem", fsType)
+	}
+
+	b, err := strconv.ParseInt(bsize, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(blocks, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return b * n, nil
+}
+
+// growFS grows the filesystem mounted at path to the size of its device, if
+// the device has been grown since the filesystem was created.
+func growFS(device, path, fsType string) error {
+	var grow []string
+	switch fsType {
+	case "xfs":
+		grow = []string{"xfs_growfs", path}
+	case "ext2", "ext3", "ext4":
+		grow = []string{"resize2fs", device}
+	default:
+		log.Printf("not checking size of %q filesystem on %s, growing is not supported", fsType, device)
+		return nil
+	}
+
+	devSize, err := blockDeviceSize(device)
+	if err != nil {
+		return err
+	}
+	before, err := fsSize(device, path, fsType)
+	if err != nil {
+		return err
+	}
+
+	if devSize-before < minGrowBytes {
+		return nil
+	}
+
+	log.Printf("device %s (%d bytes) is larger than its %s filesystem (%d bytes), growing", device, devSize, fsType, before)
+
+	out, err := change(grow[0], grow[1:]...)
+	if err != nil {
+		return fmt.Errorf("unable to grow %s filesystem on %s: %v: %s", fsType, device, err, out)
+	}
+
+	after, err := fsSize(device, path, fsType)
+	if err != nil {
+		return err
+	}
+	log.Printf("grew %s filesystem on %s from %d to %d bytes", fsType, device, before, after)
+
+	return nil
+}
+
+// Properties binding a filesystem to the resource definition it was created for.
+const (
+	fsUUIDProp  = auxPrefix + "fs-uuid"
+	fsLabelProp = auxPrefix + "fs-label"
+)
+
+// volumeProp returns the name of a per volume property. Volume 0 uses the
+// plain name, as it did before other volumes were supported.
+func volumeProp(prop string, volume int) string {
+	if volume == 0 {
+		return prop
+	}
+	return fmt.Sprintf("%s-%d", prop, volume)
+}
+
+// blkInfo holds the attributes blkid reports for a device.
+type blkInfo map[string]string
+
+func (b blkInfo) fsType() string { return b["ID_FS_TYPE"] }
+func (b blkInfo) uuid() string   { return b["ID_FS_UUID"] }
+func (b blkInfo) label() string  { return b["ID_FS_LABEL"] }
+
+// probeDevice runs a low level blkid probe on device, bypassing the cache so
+// freshly created filesystems are seen.
+func probeDevice(device string) (blkInfo, error) {
+	info := blkInfo{}
+
+	out, err := run("blkid", "-p", "-o", "udev", device)
+	if err != nil {
+		// blkid exits with 2 if it found nothing to report.
+		if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 2 {
+			return info, fmt.Errorf("unable to probe %s: %v: %s", device, err, out)
+		}
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		p := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(p) == 2 {
+			info[p[0]] = p[1]
+		}
+	}
+	return info, nil
+}
+
+// fsLabel returns the label for a filesystem on a volume of resource. Names
+// are cut to the longest label the filesystem supports.
+func fsLabel(resource string, volume int, fsType string) string {
+	max := 16
+	if fsType == "xfs" {
+		max = 12
+	}
+	suffix := ""
+	if volume != 0 {
+		suffix = fmt.Sprintf("-%d", volume)
+	}
+	if len(resource)+len(suffix) > max {
+		resource = resource[:max-len(suffix)]
+	}
+	return resource + suffix
+}
+
+func setFSLabel(device, fsType, label string) error {
+	var out []byte
+	var err error
+	switch fsType {
+	case "xfs":
+		out, err = xfsAdmin(device, "-L", label)
+	case "ext2", "ext3", "ext4":
+		out, err = change("tune2fs", "-L", label, device)
+	default:
+		return fmt.Errorf("unable to label %q filesystem", fsType)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to label filesystem on %s: %v: %s", device, err, out)
+	}
+	return nil
+}
+
+// newFSUUID gives the filesystem on device a new UUID. Only XFS needs this,
+// it refuses to mount a clone next to the filesystem it was cloned from.
+func newFSUUID(device, fsType string) error {
+	if fsType != "xfs" {
+		return nil
+	}
+	out, err := xfsAdmin(device, "-U", "generate")
+	if err != nil {
+		return fmt.Errorf("unable to generate new UUID for filesystem on %s: %v: %s", device, err, out)
+	}
+	return nil
+}
+
+// xfsAdmin runs xfs_admin on device. Snapshots and clones of a mounted XFS
+// filesystem carry a dirty log, which xfs_admin refuses to work with, so the
+// filesystem is mounted once first to replay it. nouuid lets it be mounted
+// next to the filesystem it was copied from.
+func xfsAdmin(device string, args ...string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "linstor-flexvolume-xfs")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+
+	if out, err := change("mount", "-t", "xfs", "-o", "nouuid", device, dir); err != nil {
+		return out, fmt.Errorf("unable to mount %s to replay its log: %v", device, err)
+	}
+	if out, err := change("umount", dir); err != nil {
+		return out, fmt.Errorf("unable to unmount %s after replaying its log: %v", device, err)
+	}
+	return change("xfs_admin", append(args, device)...)
+}
+
+// volumeFS formats and mounts the device of a LINSTOR volume. It does what
+// linstor.FSUtil.Mount does, and binds each filesystem to its resource by
+// label and UUID so that a mixed up device is never mounted.
+type volumeFS struct {
+	linstor.FSUtil
+	client linstorClient
+	device string
+	volume int
+	// Bind whatever filesystem is on the device to the resource.
+	adopt bool
+}
+
+// Mount the volume's device on path, formatting it first if it's empty.
+func (v volumeFS) Mount(path string) error {
+	if err := v.safeFormat(); err != nil {
+		return fmt.Errorf("unable to mount device: %w", err)
+	}
+
+	if v.XFSLogDev != "" {
+		if _, err := os.Stat(v.XFSLogDev); err != nil {
+			return fmt.Errorf("failed to stat xfs log device (%s): %v", v.XFSLogDev, err)
+		}
+	}
+
+	if !planned("mkdir", "-p", path) {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return fmt.Errorf("unable to mount device, failed to make mount directory: %v", err)
+		}
+	}
+
+	mountOpts := v.MountOpts
+	if mountOpts == "" {
+		mountOpts = "defaults"
+	}
+
+	out, err := change("mount", "-o", mountOpts, v.device, path)
+	if err != nil {
+		return fmt.Errorf("unable to mount device: %v: %s", err, out)
+	}
+	return nil
+}
+
+func (v volumeFS) safeFormat() error {
+	info, err := probeDevice(v.device)
+	if err != nil {
+		return fmt.Errorf("unable to format filesystem for %q: %v", v.device, err)
+	}
+
+	// Kubelet passes no fsType unless the volume sets one, a filesystem
+	// nobody asked for is not created.
+	if v.FSType == "" && info["ID_FS_USAGE"] != "filesystem" {
+		return apiError{codeInvalidOptions, fmt.Errorf("device %q has no filesystem and no fsType was given, refusing to format it",
+			v.device)}
+	}
+
+	switch {
+	case info.fsType() == v.FSType:
+		return v.checkBinding(info)
+	case info["ID_FS_USAGE"] == "filesystem":
+		return apiError{codeWrongFilesystem, fmt.Errorf("device %q already formatted with %q filesystem, refusing to overwrite with %q filesystem",
+			v.device, info.fsType(), v.FSType)}
+	}
+
+	// blkid only reports the first filesystem it recognizes, make sure there
+	// is nothing else on the device we'd be destroying.
+	if err := ensureBlank(v.device, v.Force); err != nil {
+		return err
+	}
+
+	args, err := v.mkfsArgs(fsLabel(v.Name, v.volume, v.FSType))
+	if err != nil {
+		return err
+	}
+	out, err := change("mkfs", args...)
+	if err != nil {
+		return apiError{codeFormatFailed, fmt.Errorf("couldn't create %s filesystem %v: %q", v.FSType, err, out)}
+	}
+	if dryRun {
+		// There is no filesystem to bind yet.
+		return nil
+	}
+
+	info, err = probeDevice(v.device)
+	if err != nil {
+		return err
+	}
+	return v.bind(info)
+}
+
+// checkBinding makes sure the filesystem on the device is the one that was
+// created for the resource.
+func (v volumeFS) checkBinding(info blkInfo) error {
+	def, err := v.client.resourceDefinition(v.Name)
+	if err != nil {
+		return err
+	}
+	uuid := def.RscDfnProps.get(volumeProp(fsUUIDProp, v.volume))
+	label := def.RscDfnProps.get(volumeProp(fsLabelProp, v.volume))
+
+	// Clones carry the filesystem of the resource they were created from,
+	// UUID included, labeled for that resource, or not at all if it is
+	// older than the labels. Either way it needs a UUID of its own.
+	if origin := def.RscDfnProps.get(fsOriginProp); uuid == "" && origin != "" &&
+		(info.label() == fsLabel(origin, v.volume, v.FSType) || info.label() == "" ||
+			info.label() == fsLabel(v.Name, v.volume, v.FSType)) {
+		log.Printf("binding %s filesystem cloned from resource %s on %s to resource %s", v.FSType, origin, v.device, v.Name)
+		if err := newFSUUID(v.device, v.FSType); err != nil {
+			return err
+		}
+		info, err = probeDevice(v.device)
+		if err != nil {
+			return err
+		}
+		return v.relabel(info)
+	}
+
+	// Filesystems created before the driver bound them carry no label, or
+	// already the one we would have given them. Nothing tells an unlabeled
+	// one from a filesystem that was never this resource's, so binding it
+	// is logged for the record.
+	if uuid == "" && info.label() == fsLabel(v.Name, v.volume, v.FSType) {
+		log.Printf("binding existing %s filesystem on %s to resource %s", v.FSType, v.device, v.Name)
+		return v.relabel(info)
+	}
+	if uuid == "" && info.label() == "" {
+		log.Printf("WARNING: binding unlabeled %s filesystem (UUID %q) on %s to resource %s, assuming the driver "+
+			"created it before it labeled filesystems; if it came from elsewhere, the device was mixed up",
+			v.FSType, info.uuid(), v.device, v.Name)
+		return v.relabel(info)
+	}
+
+	if uuid == info.uuid() && label == info.label() {
+		return nil
+	}
+
+	if v.adopt {
+		log.Printf("adopting %s filesystem (UUID %q, label %q) on %s for resource %s",
+			v.FSType, info.uuid(), info.label(), v.device, v.Name)
+		return v.relabel(info)
+	}
+
+	return apiError{codeWrongFilesystem, fmt.Errorf(
+		"filesystem on %s (UUID %q, label %q) does not belong to resource %s (UUID %q, label %q), "+
+			"refusing to mount it; set adoptFilesystem to bind it to the resource",
+		v.device, info.uuid(), info.label(), v.Name, uuid, label)}
+}
+
+// relabel gives the filesystem the resource's label and binds it.
+func (v volumeFS) relabel(info blkInfo) error {
+	label := fsLabel(v.Name, v.volume, v.FSType)
+	if info.label() != label {
+		if err := setFSLabel(v.device, v.FSType, label); err != nil {
+			return err
+		}
+		info["ID_FS_LABEL"] = label
+	}
+	return v.bind(info)
+}
+
+// bind records the filesystem's UUID and label on the resource definition.
+func (v volumeFS) bind(info blkInfo) error {
+	return v.client.setResourceDefinitionProps(v.Name, map[string]string{
+		volumeProp(fsUUIDProp, v.volume):  info.uuid(),
+		volumeProp(fsLabelProp, v.volume): info.label(),
+	})
+}
+
+// mkfsArgs builds the arguments to mkfs the same way linstor.FSUtil does,
+// with the given label unless fsOpts sets its own.
+func (v volumeFS) mkfsArgs(label string) ([]string, error) {
+	args := []string{"-t", v.FSType}
+
+	if v.FSOpts != "" {
+		opts := strings.Split(v.FSOpts, " ")
+		for _, o := range opts {
+			if o == "-L" {
+				return append(append(args, opts...), v.device), nil
+			}
+		}
+		return append(append(args, "-L", label), append(opts, v.device)...), nil
+	}
+
+	args = append(args, "-L", label)
+
+	// Everything below is deprecated behavior.
+
+	xfs := "xfs"
+	ext4 := "ext4"
+
+	if v.Force {
+		if v.FSType == xfs {
+			args = append(args, "-f")
+		}
+
+		if v.FSType == ext4 {
+			args = append(args, "-F")
+		}
+	}
+
+	if v.BlockSize != 0 {
+		b := strconv.FormatInt(v.BlockSize, 10)
+
+		if v.FSType == xfs {
+			b = fmt.Sprintf("size=%s", b)
+		}
+		args = append(args, "-b", b)
+	}
+
+	if v.FSType == xfs {
+		if v.XFSDataSU != "" {
+			if ok, _ := regexp.MatchString(`^\d+[kmg]?$`, v.XFSDataSU); !ok {
+				return nil, fmt.Errorf("su must be a number and optionally a prefix of k,m, or g")
+			}
+			args = append(args, "-d", fmt.Sprintf("su=%s", v.XFSDataSU))
+		}
+
+		if v.XFSDataSW != 0 {
+			args = append(args, "-d", fmt.Sprintf("sw=%d", v.XFSDataSW))
+		}
+
+		if v.XFSLogDev != "" {
+			if _, err := os.Stat(v.XFSLogDev); err != nil {
+				return nil, fmt.Errorf("failed to stat xfs log device (%s): %v", v.XFSLogDev, err)
+			}
+			args = append(args, "-l", fmt.Sprintf("logdev=%s", v.XFSLogDev))
+		}
+
+		if !v.XFSDiscardBlocks {
+			args = append(args, "-K")
+		}
+	}
+
+	return append(args, v.device), nil
+}
+
+// Size of the regions at the start and the end of a device that need to be
+// zeroed for it to be considered blank.
+const blankCheckBytes = 1 << 20
+
+// ensureBlank returns an error if device has any signature wipefs knows, or
+// non-zero data in its first or last megabyte. If force is set, signatures
+// are wiped instead so mkfs doesn't trip over them.
+func ensureBlank(device string, force bool) error {
+	out, err := run("wipefs", "--no-act", "--noheadings", "--output", "TYPE,OFFSET", device)
+	if err != nil {
+		return fmt.Errorf("unable to probe %s for signatures: %v: %s", device, err, out)
+	}
+
+	var sigs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 {
+			sigs = append(sigs, fmt.Sprintf("%s at offset %s", f[0], f[1]))
+		}
+	}
+
+	if len(sigs) != 0 {
+		if !force {
+			return apiError{codeDeviceNotBlank, fmt.Errorf("device %q is not blank, found signatures: %s; refusing to format it without force",
+				device, strings.Join(sigs, ", "))}
+		}
+		log.Printf("force formatting %s, wiping %s", device, strings.Join(sigs, ", "))
+		out, err := change("wipefs", "--all", device)
+		if err != nil {
+			return fmt.Errorf("unable to wipe signatures from %s: %v: %s", device, err, out)
+		}
+		return nil
+	}
+
+	where, err := findData(device)
+	if err != nil {
+		return err
+	}
+	if where != "" {
+		if !force {
+			return apiError{codeDeviceNotBlank, fmt.Errorf("device %q is not blank, found data in its %s; refusing to format it without force",
+				device, where)}
+		}
+		log.Printf("force formatting %s, overwriting data in its %s", device, where)
+	}
+
+	return nil
+}
+
+// findData reports whether the first or last megabyte of device contain
+// anything but zeros.
+func findData(device string) (string, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", fmt.Errorf("unable to determine size of %s: %v", device, err)
+	}
+
+	regions := []struct {
+		name   string
+		offset int64
+	}{
+		{"first megabyte", 0},
+		{"last megabyte", size - blankCheckBytes},
+	}
+
+	buf := make([]byte, blankCheckBytes)
+	for _, r := range regions {
+		if r.offset < 0 {
+			r.offset = 0
+		}
+		n, err := f.ReadAt(buf, r.offset)
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("unable to read %s of %s: %v", r.name, device, err)
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return r.name, nil
+			}
+		}
+	}
+
+	return "", nil
+}
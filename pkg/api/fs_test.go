@@ -0,0 +1,134 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeDevice writes a file of size bytes standing in for a device, with a
+// non-zero byte at each of the offsets.
+func writeDevice(t *testing.T, path string, size int64, data ...int64) {
+	buf := make([]byte, size)
+	for _, o := range data {
+		buf[o] = 0xff
+	}
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatalf("Expected to write %s, got %v", path, err)
+	}
+}
+
+func TestFindData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linstor-flexvolume-fs")
+	if err != nil {
+		t.Fatalf("Expected a temporary directory, got %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const size = 4 * blankCheckBytes
+	var tableTests = []struct {
+		size  int64
+		data  []int64
+		where string
+	}{
+		{size, nil, ""},
+		{size, []int64{0}, "first megabyte"},
+		{size, []int64{blankCheckBytes - 1}, "first megabyte"},
+		{size, []int64{size - 1}, "last megabyte"},
+		{size, []int64{size - blankCheckBytes}, "last megabyte"},
+		{size, []int64{0, size - 1}, "first megabyte"},
+		// Only the regions mkfs and partition tables write to are read.
+		{size, []int64{blankCheckBytes, size - blankCheckBytes - 1}, ""},
+		// Devices smaller than the regions are read in full.
+		{blankCheckBytes / 2, nil, ""},
+		{blankCheckBytes / 2, []int64{blankCheckBytes/2 - 1}, "first megabyte"},
+		{0, nil, ""},
+	}
+
+	for i, tt := range tableTests {
+		path := filepath.Join(dir, "device")
+		writeDevice(t, path, tt.size, tt.data...)
+		where, err := findData(path)
+		if err != nil {
+			t.Errorf("Expected case %d to be read, got %v", i, err)
+			continue
+		}
+		if where != tt.where {
+			t.Errorf("Expected %q for data at %v of %d bytes, got %q", tt.where, tt.data, tt.size, where)
+		}
+	}
+
+	if _, err := findData(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected an error for a missing device, got none")
+	}
+}
+
+func TestEnsureBlank(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linstor-flexvolume-fs")
+	if err != nil {
+		t.Fatalf("Expected a temporary directory, got %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// wipefs reports the signatures in $SIGNATURES and records wiping them.
+	wipefs := "#!/bin/sh\nif [ \"$1\" = --all ]; then touch " + filepath.Join(dir, "wiped") + "; else printf \"$SIGNATURES\"; fi\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "wipefs"), []byte(wipefs), 0755); err != nil {
+		t.Fatalf("Expected to write wipefs, got %v", err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	defer os.Unsetenv("SIGNATURES")
+
+	const size = 4 * blankCheckBytes
+	var tableTests = []struct {
+		signatures string
+		data       []int64
+		force      bool
+		code       errorCode
+		wiped      bool
+	}{
+		{"", nil, false, "", false},
+		{"ext4 0x438\\n", nil, false, codeDeviceNotBlank, false},
+		{"ext4 0x438\\nPMBR 0x1fe\\n", nil, true, "", true},
+		{"", []int64{0}, false, codeDeviceNotBlank, false},
+		{"", []int64{size - 1}, false, codeDeviceNotBlank, false},
+		{"", []int64{size - 1}, true, "", false},
+	}
+
+	for _, tt := range tableTests {
+		device := filepath.Join(dir, "device")
+		writeDevice(t, device, size, tt.data...)
+		os.Remove(filepath.Join(dir, "wiped"))
+		os.Setenv("SIGNATURES", tt.signatures)
+
+		err := ensureBlank(device, tt.force)
+		if tt.code == "" && err != nil {
+			t.Errorf("Expected %q with data at %v (force %t) to be blank, got %v", tt.signatures, tt.data, tt.force, err)
+		}
+		if tt.code != "" && (err == nil || errorCodeOf(err) != tt.code) {
+			t.Errorf("Expected %s for %q with data at %v (force %t), got %v", tt.code, tt.signatures, tt.data, tt.force, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "wiped")); (err == nil) != tt.wiped {
+			t.Errorf("Expected wiped %t for %q (force %t), got %t", tt.wiped, tt.signatures, tt.force, err == nil)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	linstor "github.com/LINBIT/golinstor"
+)
+
+type gcItem struct {
+	Action   string `json:"action"`
+	Resource string `json:"resource,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Done     bool   `json:"done"`
+	Error    string `json:"error,omitempty"`
+}
+
+type gcResponse struct {
+	response
+	Applied bool     `json:"applied"`
+	Items   []gcItem `json:"items"`
+}
+
+// gcCandidates finds global mounts no pod uses and diskless assignments to
+// this node that nothing has mounted, counting the stale global mounts as
+// gone. Only resources the driver attached, tagged with the PV name or as
+// ephemeral, are unassigned; others may be used outside of Kubernetes.
+func gcCandidates(c linstorClient, cfg nodeConfig, node string) ([]gcItem, error) {
+	vols, err := localVolumes(c, cfg, node)
+	if err != nil {
+		return nil, err
+	}
+	defs, err := c.resourceDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	attached := map[string]bool{}
+	for _, def := range defs {
+		attached[def.RscName] = def.RscDfnProps.get(pvNameProp) != "" ||
+			def.RscDfnProps.get(ephemeralProp) == "true"
+	}
+	mounts, err := listMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	// The device may be in use somewhere besides kubelet's directories, only
+	// a global mount that is the sole mount of its device is stale.
+	used := func(device, except string) bool {
+		for _, m := range mounts {
+			if m.Target != except && sameDevice(m.Source, device) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var items []gcItem
+	unused := map[string]bool{}
+	for _, v := range vols {
+		if _, ok := unused[v.Resource]; !ok {
+			unused[v.Resource] = v.Diskless && attached[v.Resource]
+		}
+		if v.Device == "" || !used(v.Device, v.GlobalMount) {
+			if v.GlobalMount != "" {
+				items = append(items, gcItem{Action: "unmount", Resource: v.Resource, Path: v.GlobalMount})
+			}
+			continue
+		}
+		unused[v.Resource] = false
+	}
+
+	// Global mounts of devices LINSTOR doesn't know anymore.
+	global, err := driverMounts(cfg.mountsDir())
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range global {
+		known := false
+		for _, v := range vols {
+			known = known || (v.Device != "" && sameDevice(m.Source, v.Device))
+		}
+		if !known && !used(m.Source, m.Target) {
+			items = append(items, gcItem{Action: "unmount", Path: m.Target})
+		}
+	}
+
+	for _, v := range vols {
+		if unused[v.Resource] {
+			items = append(items, gcItem{Action: "unassign", Resource: v.Resource})
+			unused[v.Resource] = false
+		}
+	}
+	return items, nil
+}
+
+// gc cleans up after detach and unmountdevice calls that failed or never
+// happened. Without -apply it only reports what it would do. With -apply it
+// looks twice, -settle apart, and only acts on what it found both times, so
+// that volumes kubelet is just attaching or mounting are left alone.
+func (api FlexVolumeApi) gc(args []string) (string, int) {
+	flags := api.newFlagSet()
+	output := outputFlag(flags)
+	controllers := flags.String("controllers", "", "LINSTOR controllers, overrides the node config")
+	apply := flags.Bool("apply", false, "unmount and unassign, rather than only report")
+	settle := flags.Duration("settle", 10*time.Second, "time between the two looks before applying")
+	if err := flags.Parse(args); err != nil {
+		return api.fmtAPIError(err)
+	}
+	if err := checkOutputFormat(*output); err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	node, err := cfg.localNode()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	c := adminClient(cfg, *controllers)
+
+	items, err := gcCandidates(c, cfg, node)
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	resp := gcResponse{response: response{Status: "Success"}, Applied: *apply, Items: []gcItem{}}
+	ret := EXITSUCCESS
+
+	if *apply && len(items) > 0 {
+		time.Sleep(*settle)
+		again, err := gcCandidates(c, cfg, node)
+		if err != nil {
+			return api.fmtAPIError(err)
+		}
+		stable := []gcItem{}
+		for _, a := range again {
+			for _, i := range items {
+				if a == i {
+					stable = append(stable, a)
+				}
+			}
+		}
+		items = stable
+
+		failed := map[string]bool{}
+		for i := range items {
+			it := &items[i]
+			switch it.Action {
+			case "unmount":
+				err = unmountPath(it.Path)
+			case "unassign":
+				if failed[it.Resource] {
+					err = fmt.Errorf("not unassigning, unmounting failed")
+					break
+				}
+				err = unassign(c, linstor.NewResourceDeployment(linstor.ResourceDeploymentConfig{
+					Name:        it.Resource,
+					Controllers: c.controllers,
+					LogOut:      logOutput,
+				}), node)
+			}
+			if err != nil {
+				it.Error = err.Error()
+				failed[it.Resource] = true
+				resp.Status = "Failure"
+				ret = EXITBADAPICALL
+			} else {
+				it.Done = true
+			}
+			log.Printf("gc: %s %s%s: done %t %s", it.Action, it.Resource, it.Path, it.Done, it.Error)
+		}
+	}
+	resp.Items = append(resp.Items, items...)
+
+	if *output == "json" {
+		res, _ := json.Marshal(resp)
+		return string(res), ret
+	}
+
+	rows := [][]string{}
+	for _, it := range resp.Items {
+		rows = append(rows, []string{it.Action, it.Resource, it.Path, strconv.FormatBool(it.Done), it.Error})
+	}
+	out := formatTable([]string{"ACTION", "RESOURCE", "PATH", "DONE", "ERROR"}, rows)
+	if !*apply {
+		out += "dry run, rerun with -apply to carry this out\n"
+	}
+	return out, ret
+}
@@ -0,0 +1,179 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	linstor "github.com/LINBIT/golinstor"
+)
+
+// golinstor runs the linstor client itself, without the TLS settings and
+// without a way to record a plan, and it can't be changed here. When either
+// is needed, the wrappers below run the commands golinstor would run through
+// c instead, and judge the answers as strictly as golinstor does, so that a
+// call behaves the same either way. Otherwise they retry golinstor like
+// linstorClient retries changes, timing each attempt as one command in the
+// metrics, however many times golinstor runs the client.
+
+func viaClient(c linstorClient) bool {
+	return dryRun || c.tls.enabled()
+}
+
+// timed runs f, a golinstor call that runs command, timing it as a run of
+// command.
+func timed(command string, f func() error) func() error {
+	return func() error {
+		start := time.Now()
+		defer func() { timeCommand(command, time.Since(start)) }()
+		return f()
+	}
+}
+
+// doAsGolinstor is c.do, failing on warnings and infos too, like golinstor.
+func (c linstorClient) doAsGolinstor(args ...string) error {
+	return c.doChecked(returnStatuses.validateAll, args...)
+}
+
+// assign is r.Assign.
+func assign(c linstorClient, r linstor.ResourceDeployment) error {
+	if !viaClient(c) {
+		r.Controllers = pinController(r.Controllers)
+		return retryMutation("assigning "+r.Name, timed("linstor", r.Assign))
+	}
+	if err := deploy(c, r, r.NodeList, "-s", r.StoragePool); err != nil {
+		return err
+	}
+	if r.AutoPlace > 0 {
+		args := []string{"resource", "create", r.Name, "-s", r.StoragePool, "--auto-place", strconv.FormatUint(r.AutoPlace, 10)}
+		if r.DoNotPlaceWithRegex != "" {
+			args = append(args, "--do-not-place-with-regex", r.DoNotPlaceWithRegex)
+		}
+		if len(r.ReplicasOnSame) != 0 {
+			args = append(append(args, "--replicas-on-same"), r.ReplicasOnSame...)
+		}
+		if len(r.ReplicasOnDifferent) != 0 {
+			args = append(append(args, "--replicas-on-different"), r.ReplicasOnDifferent...)
+		}
+		if err := c.doAsGolinstor(args...); err != nil {
+			return err
+		}
+	}
+	return deploy(c, r, r.ClientList, "-s", r.DisklessStoragePool, "--diskless")
+}
+
+func deploy(c linstorClient, r linstor.ResourceDeployment, nodes []string, args ...string) error {
+	for _, node := range nodes {
+		present, err := c.deployed(r.Name, node)
+		if err != nil {
+			return fmt.Errorf("unable to assign resource %s failed to check if it was already present on node %s: %v", r.Name, node, err)
+		}
+		if !present {
+			if err := c.doAsGolinstor(append([]string{"resource", "create", node, r.Name}, args...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createAndAssign is r.CreateAndAssign.
+func createAndAssign(c linstorClient, r linstor.ResourceDeployment) error {
+	if !viaClient(c) {
+		r.Controllers = pinController(r.Controllers)
+		return retryMutation("creating "+r.Name, timed("linstor", r.CreateAndAssign))
+	}
+	defs, err := c.resourceDefinitions()
+	if err != nil {
+		return err
+	}
+	def := resDef{}
+	for _, d := range defs {
+		if d.RscName == r.Name {
+			def = d
+		}
+	}
+	if def.RscName == "" {
+		if err := c.doAsGolinstor("resource-definition", "create", r.Name); err != nil {
+			return fmt.Errorf("unable to reserve resource name %s :%v", r.Name, err)
+		}
+	}
+	if def.hasVolume(0) != nil {
+		args := []string{"volume-definition", "create", r.Name, fmt.Sprintf("%dkib", r.SizeKiB)}
+		if r.Encryption {
+			args = append(args, "--encrypt")
+		}
+		if err := c.doAsGolinstor(args...); err != nil {
+			return fmt.Errorf("unable to reserve resource name %s :%v", r.Name, err)
+		}
+	}
+	return assign(c, r)
+}
+
+// unassign is r.Unassign.
+func unassign(c linstorClient, r linstor.ResourceDeployment, node string) error {
+	if !viaClient(c) {
+		r.Controllers = pinController(r.Controllers)
+		return retryMutation("unassigning "+r.Name, timed("linstor", func() error { return r.Unassign(node) }))
+	}
+	if err := c.doAsGolinstor("resource", "delete", node, r.Name); err != nil {
+		return fmt.Errorf("failed to unassign resource %s from node %s: %v", r.Name, node, err)
+	}
+	return nil
+}
+
+// deleteResource is r.Delete.
+func deleteResource(c linstorClient, r linstor.ResourceDeployment) error {
+	if !viaClient(c) {
+		r.Controllers = pinController(r.Controllers)
+		return retryMutation("deleting "+r.Name, timed("linstor", r.Delete))
+	}
+	defs, err := c.resourceDefinitions()
+	if err != nil {
+		return fmt.Errorf("failed to delete resource %s: %v", r.Name, err)
+	}
+	for _, d := range defs {
+		if d.RscName == r.Name {
+			if err := c.doAsGolinstor("resource-definition", "delete", r.Name); err != nil {
+				return fmt.Errorf("failed to delete resource %s: %v", r.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// unmountPath is linstor.FSUtil.UnMount.
+func unmountPath(path string) error {
+	if !dryRun {
+		return timed("umount", func() error { return linstor.FSUtil{}.UnMount(path) })()
+	}
+	mounts, err := listMounts()
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if m.Target == path {
+			planned("umount", path)
+			break
+		}
+	}
+	return nil
+}
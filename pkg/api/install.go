@@ -0,0 +1,248 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const binaryName = "linstor-flexvolume"
+
+type installResponse struct {
+	response
+	Path             string `json:"path"`
+	Version          string `json:"version"`
+	InstalledVersion string `json:"installedVersion,omitempty"`
+	Installed        bool   `json:"installed"`
+	Previous         string `json:"previous,omitempty"`
+	Config           string `json:"config,omitempty"`
+}
+
+// writeFileAtomic replaces path with a file holding data. Readers see either
+// the old or the new file, never a partial one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	// Hidden, so that nothing picks up the partial file by its name.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+var versionRe = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(?:-(\d+)-g[0-9a-f]+)?`)
+
+// compareVersions compares versions as set by the Makefile from git describe.
+// ok is false if either can't be parsed.
+func compareVersions(a, b string) (cmp int, ok bool) {
+	ma, mb := versionRe.FindStringSubmatch(a), versionRe.FindStringSubmatch(b)
+	if ma == nil || mb == nil {
+		return 0, false
+	}
+	for i := 1; i < len(ma); i++ {
+		x, _ := strconv.Atoi(ma[i])
+		y, _ := strconv.Atoi(mb[i])
+		if x != y {
+			if x < y {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+// install copies the running binary to the kubelet plugin directory. With
+// -loop it keeps doing so, which is how an installer DaemonSet runs it.
+func (api FlexVolumeApi) install(args []string) (string, int) {
+	flags := api.newFlagSet()
+	pluginDir := flags.String("plugin-dir", "", "kubelet volume plugin directory, overrides the node config")
+	config := flags.String("config", "", "node config to write, as JSON")
+	force := flags.Bool("force", false, "install even if the installed version is the same or newer")
+	rollback := flags.Bool("rollback", false, "restore the binary replaced by the last install")
+	loop := flags.Duration("loop", 0, "install again at this interval, forever")
+	if err := flags.Parse(args); err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	if *config != "" {
+		cfg := nodeConfig{}
+		if err := json.Unmarshal([]byte(*config), &cfg); err != nil {
+			return api.fmtAPIError(fmt.Errorf("couldn't parse node config: %v", err))
+		}
+	}
+
+	for {
+		resp, err := api.installOnce(*pluginDir, *config, *force, *rollback)
+		if err == nil && !*rollback {
+			// Keep the node's topology labels mapped, they may change.
+			api.installTopology()
+		}
+		if err != nil {
+			out, ret := api.fmtAPIError(err)
+			if *loop == 0 {
+				return out, ret
+			}
+			log.Print(out)
+		} else {
+			res, _ := json.Marshal(resp)
+			if *loop == 0 {
+				return string(res), EXITSUCCESS
+			}
+			if resp.Installed {
+				log.Printf("installed %s", res)
+			}
+		}
+		time.Sleep(*loop)
+	}
+}
+
+// installTopology maps the node's topology labels, failures are only logged.
+func (api FlexVolumeApi) installTopology() {
+	cfg, err := loadNodeConfig()
+	if err != nil || len(cfg.topologyMapping()) == 0 {
+		return
+	}
+	node, err := cfg.localNode()
+	if err == nil {
+		_, err = syncTopology(cfg, adminClient(cfg, ""), node)
+	}
+	if err != nil {
+		log.Printf("unable to map topology labels: %v", err)
+	}
+}
+
+func (api FlexVolumeApi) installOnce(pluginDir, config string, force, rollback bool) (installResponse, error) {
+	resp := installResponse{response: response{Status: "Success"}, Version: api.Version}
+
+	if config != "" {
+		if err := os.MkdirAll(filepath.Dir(configPath()), 0755); err != nil {
+			return resp, err
+		}
+		current, _ := ioutil.ReadFile(configPath())
+		if !bytes.Equal(current, []byte(config)) {
+			if err := writeFileAtomic(configPath(), []byte(config), 0644); err != nil {
+				return resp, fmt.Errorf("couldn't write node config: %v", err)
+			}
+		}
+		resp.Config = configPath()
+	}
+
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return resp, err
+	}
+	if pluginDir == "" {
+		pluginDir = cfg.PluginDir
+	}
+	dir := filepath.Join(pluginDir, pluginDirName)
+	target := filepath.Join(dir, binaryName)
+	previous := target + ".previous"
+	resp.Path = target
+
+	if rollback {
+		if _, err := os.Stat(previous); err != nil {
+			return resp, fmt.Errorf("nothing to roll back to: %v", err)
+		}
+		if err := os.Rename(previous, target); err != nil {
+			return resp, err
+		}
+		resp.Installed = true
+		resp.Message = "restored the previous binary"
+		return resp, nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return resp, err
+	}
+	bin, err := ioutil.ReadFile(self)
+	if err != nil {
+		return resp, err
+	}
+
+	installed, err := ioutil.ReadFile(target)
+	if err != nil && !os.IsNotExist(err) {
+		return resp, err
+	}
+	if installed != nil {
+		if bytes.Equal(installed, bin) {
+			resp.InstalledVersion = api.Version
+			resp.Message = "up to date"
+			return resp, nil
+		}
+		out, err := exec.Command(target, "--version").Output()
+		if err == nil {
+			resp.InstalledVersion = strings.TrimSpace(string(out))
+		}
+		if cmp, ok := compareVersions(api.Version, resp.InstalledVersion); ok && cmp <= 0 && !force {
+			resp.Message = fmt.Sprintf("installed version %s is not older than %s", resp.InstalledVersion, api.Version)
+			return resp, nil
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return resp, err
+	}
+	// Keep the binary that is replaced, so it can be rolled back to. The link
+	// leaves it in place until the new one is renamed over it.
+	if installed != nil {
+		tmp := previous + ".tmp"
+		os.Remove(tmp)
+		if err := os.Link(target, tmp); err != nil {
+			return resp, fmt.Errorf("couldn't keep the installed binary: %v", err)
+		}
+		if err := os.Rename(tmp, previous); err != nil {
+			return resp, fmt.Errorf("couldn't keep the installed binary: %v", err)
+		}
+		resp.Previous = previous
+	}
+	if err := writeFileAtomic(target, bin, 0755); err != nil {
+		return resp, fmt.Errorf("couldn't install %s: %v", target, err)
+	}
+
+	resp.Installed = true
+	return resp, nil
+}
@@ -0,0 +1,52 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	var tableTests = []struct {
+		a, b string
+		cmp  int
+		ok   bool
+	}{
+		{"v0.7.2", "v0.7.2", 0, true},
+		{"0.7.2", "v0.7.2", 0, true},
+		{"v0.7.2", "v0.7.10", -1, true},
+		{"v0.10.0", "v0.9.9", 1, true},
+		{"v1.0.0", "v0.99.99", 1, true},
+		// Builds after a tag, as git describe names them, come after it.
+		{"v0.7.2-3-g1a2b3c4", "v0.7.2", 1, true},
+		{"v0.7.2-3-g1a2b3c4", "v0.7.2-12-gdeadbee", -1, true},
+		{"v0.7.2-3-g1a2b3c4", "v0.7.3", -1, true},
+		{"v0.7.2-3-g1a2b3c4-dirty", "v0.7.2-3-g1a2b3c4", 0, true},
+		{"v0.7.2-dirty", "v0.7.2", 0, true},
+		{"", "v0.7.2", 0, false},
+		{"v0.7.2", "unknown", 0, false},
+		{"1a2b3c4", "v0.7.2", 0, false},
+		{"v0.7", "v0.7.2", 0, false},
+	}
+
+	for _, tt := range tableTests {
+		cmp, ok := compareVersions(tt.a, tt.b)
+		if cmp != tt.cmp || ok != tt.ok {
+			t.Errorf("Expected %d %t comparing %q to %q, got %d %t", tt.cmp, tt.ok, tt.a, tt.b, cmp, ok)
+		}
+	}
+}
@@ -0,0 +1,616 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Properties the driver keeps on LINSTOR objects are namespaced under this prefix.
+const auxPrefix = "Aux/linstor-flexvolume/"
+
+// The name of the PV a resource was last attached for.
+const pvNameProp = auxPrefix + "pv-name"
+
+// linstorClient runs the linstor client for the calls golinstor does not cover.
+type linstorClient struct {
+	controllers string
+	tls         tlsSettings
+	// Fed to the client's standard input, for values that must not show
+	// up in its arguments.
+	input string
+}
+
+// withInput returns a copy of c that feeds input to the client.
+func (c linstorClient) withInput(input string) linstorClient {
+	c.input = input
+	return c
+}
+
+type prop struct {
+	Value string `json:"value"`
+	Key   string `json:"key"`
+}
+
+type props []prop
+
+func (p props) get(key string) string {
+	for _, kv := range p {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return ""
+}
+
+type returnStatuses []struct {
+	MessageFormat string `json:"message_format"`
+	CauseFormat   string `json:"cause_format,omitempty"`
+	DetailsFormat string `json:"details_format"`
+	RetCode       uint64 `json:"ret_code"`
+}
+
+// Only errors fail a call, warnings and infos are passed along in the log.
+const maskError = 0xC000000000000000
+
+// LINSTOR return codes without the bits for severity, operation and object
+// fall into ranges of a hundred by kind of failure, as in LINSTOR's ApiConsts.
+// Those from 1000 on are single codes of failures that fit no kind.
+const (
+	maskRetCode  = 0xFFFF
+	failInvalid  = 100 // FAIL_INVLD_*, a name, size or property not valid
+	failNotFound = 300
+	failExists   = 500
+
+	failStorPoolConfiguration = 1002
+	failNotEnoughNodes        = 1006
+)
+
+// Both the driver and golinstor report failed operations with this prefix,
+// followed by the return statuses.
+const statusErrorPrefix = "error status from one or more linstor operations: "
+
+func (s returnStatuses) validate() error {
+	return s.check(func(retCode uint64) bool { return retCode&maskError == maskError })
+}
+
+// validateAll fails on warnings and infos as well as on errors.
+func (s returnStatuses) validateAll() error {
+	return s.check(func(retCode uint64) bool { return retCode&maskError != 0 })
+}
+
+func (s returnStatuses) check(failed func(uint64) bool) error {
+	for _, st := range s {
+		if failed(st.RetCode) {
+			msg, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("%s%s", statusErrorPrefix, msg)
+		}
+	}
+	return nil
+}
+
+// failure returns the code of the first error status, without the bits for
+// severity, operation and object.
+func (s returnStatuses) failure() (uint64, bool) {
+	for _, st := range s {
+		if st.RetCode&maskError == maskError {
+			return st.RetCode & maskRetCode, true
+		}
+	}
+	return 0, false
+}
+
+// retCodeOf returns the LINSTOR return code err reports, if it is a failed
+// operation the controller answered.
+func retCodeOf(err error) (uint64, bool) {
+	msg := err.Error()
+	i := strings.Index(msg, statusErrorPrefix)
+	if i < 0 {
+		return 0, false
+	}
+	s := returnStatuses{}
+	if json.NewDecoder(strings.NewReader(msg[i+len(statusErrorPrefix):])).Decode(&s) != nil {
+		return 0, false
+	}
+	return s.failure()
+}
+
+// retCodeIn tells if code falls into the range of kind.
+func retCodeIn(code, kind uint64) bool {
+	return code >= kind && code < kind+100
+}
+
+type resDef struct {
+	VlmDfns []struct {
+		VlmNr       int      `json:"vlm_nr"`
+		VlmSize     int      `json:"vlm_size"`
+		VlmDfnFlags []string `json:"vlm_dfn_flags,omitempty"`
+	} `json:"vlm_dfns,omitempty"`
+	RscName     string `json:"rsc_name"`
+	RscDfnProps props  `json:"rsc_dfn_props,omitempty"`
+}
+
+type resource struct {
+	Vlms []struct {
+		VlmNr        int    `json:"vlm_nr"`
+		StorPoolName string `json:"stor_pool_name"`
+		DevicePath   string `json:"device_path"`
+		// In KiB, only reported by satellites that know it.
+		AllocatedSize *int64 `json:"allocated_size,omitempty"`
+	} `json:"vlms"`
+	NodeName string   `json:"node_name"`
+	Name     string   `json:"name"`
+	Props    props    `json:"props"`
+	RscFlags []string `json:"rsc_flags,omitempty"`
+	// Only reported by satellites that know it.
+	LayerObject struct {
+		DRBD struct {
+			Connections drbdConnections `json:"connections,omitempty"`
+		} `json:"drbd"`
+	} `json:"layer_object"`
+}
+
+// drbdConnections are the states of the DRBD connections of a resource to its
+// peers, by peer node.
+type drbdConnections map[string]struct {
+	Connected bool   `json:"connected"`
+	Message   string `json:"message"`
+}
+
+func (r resource) diskless() bool {
+	for _, f := range r.RscFlags {
+		if f == "DISKLESS" {
+			return true
+		}
+	}
+	return false
+}
+
+type resourceState struct {
+	RscName   string `json:"rsc_name"`
+	NodeName  string `json:"node_name"`
+	IsPresent bool   `json:"is_present"`
+	VlmStates []struct {
+		VlmNr     int    `json:"vlm_nr"`
+		DiskState string `json:"disk_state"`
+		// In KiB, only reported by satellites that know it.
+		OutOfSync *int64 `json:"out_of_sync,omitempty"`
+	} `json:"vlm_states"`
+}
+
+type resList []struct {
+	ResourceStates []resourceState `json:"resource_states"`
+	Resources      []resource      `json:"resources"`
+}
+
+type node struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Props props  `json:"props"`
+}
+
+// auxValues returns the values of the node's aux properties called names,
+// and whether it has all of them.
+func (n node) auxValues(names []string) ([]string, bool) {
+	var values []string
+	for _, name := range names {
+		v := n.Props.get("Aux/" + name)
+		if v == "" {
+			return nil, false
+		}
+		values = append(values, v)
+	}
+	return values, true
+}
+
+type nodeList []struct {
+	Nodes []node `json:"nodes"`
+}
+
+type storagePool struct {
+	StorPoolName string `json:"stor_pool_name"`
+	NodeName     string `json:"node_name"`
+	Driver       string `json:"driver"`
+	FreeSpace    struct {
+		FreeCapacity  int64 `json:"free_capacity"`
+		TotalCapacity int64 `json:"total_capacity"`
+	} `json:"free_space"`
+}
+
+type storagePoolList []struct {
+	StorPools []storagePool `json:"stor_pools"`
+}
+
+type resDefList []struct {
+	RscDfns []resDef `json:"rsc_dfns"`
+}
+
+func (c linstorClient) args(args ...string) []string {
+	a := []string{"-m"}
+	controllers := c.tlsControllers()
+	if c.tls.enabled() {
+		var ssl []string
+		for _, ctrl := range splitControllers(controllers) {
+			ssl = append(ssl, sslController(ctrl))
+		}
+		controllers = strings.Join(ssl, ",")
+		a = append(a, c.tls.args()...)
+	}
+	if controllers != "" {
+		a = append(a, "--controllers", controllers)
+	}
+	return append(a, args...)
+}
+
+// isClient determines if resource is deployed diskless on node.
+func (c linstorClient) isClient(resource, node string) (bool, error) {
+	list, err := c.resources()
+	if err != nil {
+		return false, err
+	}
+	for _, r := range list {
+		if r.Name == resource && r.NodeName == node {
+			return r.diskless(), nil
+		}
+	}
+	return false, nil
+}
+
+// deployed determines if resource is deployed on node at all.
+func (c linstorClient) deployed(resource, node string) (bool, error) {
+	list, err := c.resources()
+	if err != nil {
+		return false, err
+	}
+	for _, r := range list {
+		if r.Name == resource && r.NodeName == node {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// query runs a linstor list command and decodes its output into v.
+func (c linstorClient) query(v interface{}, args ...string) error {
+	return retry("linstor "+strings.Join(redact(args), " "), func() error {
+		return c.queryOnce(v, args...)
+	})
+}
+
+func (c linstorClient) queryOnce(v interface{}, args ...string) error {
+	out, err := c.runLinstor(args...)
+	if err != nil && len(out) == 0 {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		return fmt.Errorf("couldn't Unmarshal %s :%v", out, err)
+	}
+	return nil
+}
+
+// do runs a linstor command that answers with return statuses.
+func (c linstorClient) do(args ...string) error {
+	return c.doChecked(returnStatuses.validate, args...)
+}
+
+// doChecked is do, with the answer checked by validate.
+func (c linstorClient) doChecked(validate func(returnStatuses) error, args ...string) error {
+	if planned("linstor", c.args(args...)...) {
+		return nil
+	}
+	return retryMutation("linstor "+strings.Join(redact(args), " "), func() error {
+		s := returnStatuses{}
+		if err := c.queryOnce(&s, args...); err != nil {
+			return err
+		}
+		return validate(s)
+	})
+}
+
+func (c linstorClient) nodes() ([]node, error) {
+	list := nodeList{}
+	if err := c.query(&list, "node", "list"); err != nil {
+		return nil, err
+	}
+	var nodes []node
+	for _, l := range list {
+		nodes = append(nodes, l.Nodes...)
+	}
+	return nodes, nil
+}
+
+func (c linstorClient) storagePools() ([]storagePool, error) {
+	list := storagePoolList{}
+	if err := c.query(&list, "storage-pool", "list"); err != nil {
+		return nil, err
+	}
+	var pools []storagePool
+	for _, l := range list {
+		pools = append(pools, l.StorPools...)
+	}
+	return pools, nil
+}
+
+// resources lists the resources deployed on all nodes.
+func (c linstorClient) resources() ([]resource, error) {
+	res, _, err := c.resourcesWithStates()
+	return res, err
+}
+
+// resourcesWithStates lists the resources deployed on all nodes along with
+// the state the satellites report for them.
+func (c linstorClient) resourcesWithStates() ([]resource, []resourceState, error) {
+	list := resList{}
+	if err := c.query(&list, "resource", "list"); err != nil {
+		return nil, nil, err
+	}
+	var res []resource
+	var states []resourceState
+	for _, l := range list {
+		res = append(res, l.Resources...)
+		states = append(states, l.ResourceStates...)
+	}
+	return res, states, nil
+}
+
+// healthyReplicas returns the nodes with an UpToDate replica of a volume of
+// resource that node is connected to, including node itself, as LINSTOR
+// reports them.
+func (c linstorClient) healthyReplicas(resource string, volume int, node string) ([]string, error) {
+	res, states, err := c.resourcesWithStates()
+	if err != nil {
+		return nil, err
+	}
+	return upToDate(res, states, resource, volume, node), nil
+}
+
+// onNode determines if a volume of resource is deployed on node.
+func (c linstorClient) onNode(resource string, volume int, node string) (bool, error) {
+	list, err := c.resources()
+	if err != nil {
+		return false, err
+	}
+	for _, r := range list {
+		if r.Name != resource || r.NodeName != node {
+			continue
+		}
+		for _, v := range r.Vlms {
+			if v.VlmNr == volume {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// devicePath returns the device of a volume of resource on node.
+func (c linstorClient) devicePath(resource string, volume int, node string) (string, error) {
+	list, err := c.resources()
+	if err != nil {
+		return "", err
+	}
+	for _, r := range list {
+		if r.Name != resource || r.NodeName != node {
+			continue
+		}
+		for _, v := range r.Vlms {
+			if v.VlmNr == volume && v.DevicePath != "" {
+				return v.DevicePath, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unable to find the device path of volume %d of %s on node %s", volume, resource, node)
+}
+
+// waitForDevicePath polls until the device of a volume of resource appears
+// on this node, which is node in LINSTOR.
+func (c linstorClient) waitForDevicePath(resource string, volume int, node string, maxRetries int) (string, error) {
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Second * 2)
+		}
+		var path string
+		path, err = c.devicePath(resource, volume, node)
+		if err != nil {
+			continue
+		}
+		if _, err = os.Lstat(path); err != nil {
+			err = fmt.Errorf("Couldn't stat %s: %v", path, err)
+			continue
+		}
+		return path, nil
+	}
+	return "", err
+}
+
+// hasVolume returns an error if def has no volume definition for volume.
+func (def resDef) hasVolume(volume int) error {
+	for _, v := range def.VlmDfns {
+		if v.VlmNr == volume {
+			return nil
+		}
+	}
+	return fmt.Errorf("resource %s has no volume %d", def.RscName, volume)
+}
+
+func (c linstorClient) resourceDefinitions() ([]resDef, error) {
+	list := resDefList{}
+	if err := c.query(&list, "resource-definition", "list"); err != nil {
+		return nil, err
+	}
+	var defs []resDef
+	for _, l := range list {
+		defs = append(defs, l.RscDfns...)
+	}
+	return defs, nil
+}
+
+// resourceDefinition looks up the resource definition called name.
+func (c linstorClient) resourceDefinition(name string) (resDef, error) {
+	list, err := c.resourceDefinitions()
+	if err != nil {
+		return resDef{}, err
+	}
+	for _, def := range list {
+		if def.RscName == name {
+			return def, nil
+		}
+	}
+	return resDef{}, fmt.Errorf("resource definition %s not found", name)
+}
+
+// setNodeProps sets properties on the node called name.
+func (c linstorClient) setNodeProps(name string, kv map[string]string) error {
+	return c.setProps("node", kv, name)
+}
+
+// setResourceDefinitionProps sets properties on the resource definition
+// called name. Properties set to an empty value are deleted.
+func (c linstorClient) setResourceDefinitionProps(name string, kv map[string]string) error {
+	return c.setProps("resource-definition", kv, name)
+}
+
+// setResourceProps sets properties on the resource called name on node.
+func (c linstorClient) setResourceProps(node, name string, kv map[string]string) error {
+	return c.setProps("resource", kv, node, name)
+}
+
+func (c linstorClient) setProps(object string, kv map[string]string, name ...string) error {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		args := append([]string{object, "set-property"}, name...)
+		args = append(args, k)
+		if kv[k] != "" {
+			args = append(args, kv[k])
+		}
+		if err := c.do(args...); err != nil {
+			return fmt.Errorf("unable to set property %s on %s %s: %v", k, object, strings.Join(name, " "), err)
+		}
+	}
+	return nil
+}
+
+type snapshotDef struct {
+	RscName      string   `json:"rsc_name"`
+	SnapshotName string   `json:"snapshot_name"`
+	Flags        []string `json:"snapshot_dfn_flags,omitempty"`
+	Snapshots    []struct {
+		NodeName string `json:"node_name"`
+	} `json:"snapshots,omitempty"`
+	SnapshotVlmDfns []struct {
+		VlmNr   int   `json:"vlm_nr"`
+		VlmSize int64 `json:"vlm_size"`
+	} `json:"snapshot_vlm_dfns,omitempty"`
+}
+
+type snapshotList []struct {
+	SnapshotDfns []snapshotDef `json:"snapshot_dfns"`
+}
+
+func (c linstorClient) snapshots() ([]snapshotDef, error) {
+	list := snapshotList{}
+	if err := c.query(&list, "snapshot", "list"); err != nil {
+		return nil, err
+	}
+	var snaps []snapshotDef
+	for _, l := range list {
+		snaps = append(snaps, l.SnapshotDfns...)
+	}
+	return snaps, nil
+}
+
+// hasSnapshot determines if resource has a snapshot called snapshot.
+func (c linstorClient) hasSnapshot(resource, snapshot string) (bool, error) {
+	snaps, err := c.snapshots()
+	if err != nil {
+		return false, err
+	}
+	for _, s := range snaps {
+		if s.RscName == resource && s.SnapshotName == snapshot {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c linstorClient) createSnapshot(resource, snapshot string) error {
+	if err := c.do("snapshot", "create", resource, snapshot); err != nil {
+		return fmt.Errorf("unable to create snapshot %s of resource %s: %v", snapshot, resource, err)
+	}
+	return nil
+}
+
+func (c linstorClient) deleteSnapshot(resource, snapshot string) error {
+	if err := c.do("snapshot", "delete", resource, snapshot); err != nil {
+		return fmt.Errorf("unable to delete snapshot %s of resource %s: %v", snapshot, resource, err)
+	}
+	return nil
+}
+
+// restoreSnapshot creates the resource target from a snapshot of resource.
+// The new resource is deployed to nodes, or to all nodes that hold the
+// snapshot if none are given. Its definition gets props before anything is
+// restored into it.
+func (c linstorClient) restoreSnapshot(resource, snapshot, target string, nodes []string, props map[string]string) error {
+	from := []string{"--from-resource", resource, "--from-snapshot", snapshot, "--to-resource", target}
+
+	if err := c.do("resource-definition", "create", target); err != nil {
+		return fmt.Errorf("unable to create resource definition %s: %v", target, err)
+	}
+
+	err := c.setResourceDefinitionProps(target, props)
+	if err == nil {
+		err = c.do(append([]string{"snapshot", "volume-definition", "restore"}, from...)...)
+		if err != nil {
+			err = fmt.Errorf("unable to restore volume definitions of %s from snapshot %s/%s: %v", target, resource, snapshot, err)
+		}
+	}
+	if err == nil {
+		err = c.do(append(append([]string{"snapshot", "resource", "restore"}, from...), nodes...)...)
+		if err != nil {
+			err = fmt.Errorf("unable to restore resource %s from snapshot %s/%s: %v", target, resource, snapshot, err)
+		}
+	}
+	if err != nil {
+		// Left behind, the definition would make the next attempt skip the
+		// restore and find no volumes.
+		if derr := c.do("resource-definition", "delete", target); derr != nil {
+			log.Printf("unable to delete resource definition %s after the failed restore: %v", target, derr)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Policies for placing a diskful replica on the node a volume is attached to.
+const (
+	localityNever     = "never"
+	localityPreferred = "preferred"
+	localityRequired  = "required"
+)
+
+// localReplicaProp tags replicas with local storage the driver placed for
+// the locality policy, detach removes them again.
+const localReplicaProp = auxPrefix + "local-replica"
+
+// How long attach waits for a new local replica to finish its initial sync
+// under the required locality policy.
+const localSyncTimeout = 90 * time.Second
+
+// ensureLocalReplica gives node a diskful replica of the resource if the
+// locality policy asks for it and the node has room for it in the storage
+// pool. Existing diskless assignments are converted.
+func ensureLocalReplica(c linstorClient, def resDef, node string, opts options) error {
+	policy := opts.LocalityPolicy
+	if policy == localityNever {
+		return nil
+	}
+
+	pool := opts.StoragePool
+	if pool == "" {
+		pool = "DfltStorPool"
+	}
+
+	res, err := c.resources()
+	if err != nil {
+		return err
+	}
+	present, diskless := false, false
+	for _, r := range res {
+		if r.Name == def.RscName && r.NodeName == node {
+			present, diskless = true, r.diskless()
+		}
+	}
+	if present && !diskless {
+		return nil
+	}
+
+	if err := localEligible(c, def, node, pool, opts.overProvisionRatio); err != nil {
+		if policy == localityRequired {
+			return fmt.Errorf("localityPolicy requires a local replica of %s: %v", def.RscName, err)
+		}
+		log.Printf("not placing a local replica of %s: %v", def.RscName, err)
+		return nil
+	}
+
+	if diskless {
+		log.Printf("converting diskless replica of %s on node %s to storage pool %s", def.RscName, node, pool)
+		err = c.do("resource", "toggle-disk", node, def.RscName, "--storage-pool", pool)
+	} else {
+		log.Printf("placing local replica of %s on node %s in storage pool %s", def.RscName, node, pool)
+		err = c.do("resource", "create", node, def.RscName, "-s", pool)
+	}
+	if err != nil {
+		if policy == localityRequired {
+			return fmt.Errorf("unable to place local replica of %s on node %s: %v", def.RscName, node, err)
+		}
+		log.Printf("unable to place local replica of %s on node %s: %v", def.RscName, node, err)
+		return nil
+	}
+	err = c.setResourceProps(node, def.RscName, map[string]string{localReplicaProp: "true"})
+	if err != nil {
+		return err
+	}
+
+	// DRBD serves reads from peers until the local replica is in sync, only
+	// the required policy has to wait for that.
+	if policy != localityRequired {
+		return nil
+	}
+	if dryRun {
+		return fmt.Errorf("local replica of %s on node %s is only planned, not waiting for it to sync", def.RscName, node)
+	}
+	return waitForSync(c, def.RscName, opts.volumeNumber, node, localSyncTimeout)
+}
+
+// localEligible returns an error if node can't hold a replica of the
+// resource in pool, over-provisioning thin pools by ratio.
+func localEligible(c linstorClient, def resDef, node, pool string, ratio float64) error {
+	var sizeKiB int64
+	for _, v := range def.VlmDfns {
+		sizeKiB += int64(v.VlmSize)
+	}
+
+	pools, err := c.storagePools()
+	if err != nil {
+		return err
+	}
+	provisioned, err := provisionedKiB(c)
+	if err != nil {
+		return err
+	}
+	for _, sp := range pools {
+		if sp.NodeName != node || sp.StorPoolName != pool {
+			continue
+		}
+		if avail := sp.availableKiB(ratio, provisioned[poolKey{node, pool}]); avail < sizeKiB {
+			return fmt.Errorf("storage pool %s on node %s has %d KiB available, %d KiB needed",
+				pool, node, avail, sizeKiB)
+		}
+		return nil
+	}
+	return fmt.Errorf("node %s has no storage pool %s", node, pool)
+}
+
+// detachable determines if detach unassigns resource from node: diskless
+// replicas, and those the driver placed for the locality policy.
+func detachable(c linstorClient, resource, node string) (bool, error) {
+	list, err := c.resources()
+	if err != nil {
+		return false, err
+	}
+	for _, r := range list {
+		if r.Name == resource && r.NodeName == node {
+			return r.diskless() || r.Props.get(localReplicaProp) == "true", nil
+		}
+	}
+	return false, nil
+}
+
+// waitForSync polls until the replica of a volume of resource on node is UpToDate.
+func waitForSync(c linstorClient, resource string, volume int, node string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		healthy, err := c.healthyReplicas(resource, volume, node)
+		if err != nil {
+			return err
+		}
+		for _, n := range healthy {
+			if n == node {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("local replica of %s on node %s did not sync within %s", resource, node, timeout)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
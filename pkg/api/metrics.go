@@ -0,0 +1,183 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Every call adds to the metrics in a file for the node exporter's textfile
+// collector. The driver runs as a new process for each call, so the file is
+// the only place the counts live.
+
+type metricFamily struct {
+	name, kind, help string
+}
+
+var metricFamilies = []metricFamily{
+	{"linstor_flexvolume_calls_total", "counter", "Driver calls by action, exit code and the step that failed."},
+	{"linstor_flexvolume_call_duration_seconds", "histogram", "Duration of driver calls by action."},
+	{"linstor_flexvolume_command_duration_seconds", "histogram", "Duration of external commands run by the driver."},
+}
+
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// The step of the running action, failed calls are counted by it.
+var currentStep string
+
+// step records that the running action moved on to the named step.
+func step(name string) {
+	currentStep = name
+}
+
+type commandTime struct {
+	command string
+	seconds float64
+}
+
+// The external commands run during this call.
+var commandTimes []commandTime
+
+func timeCommand(command string, d time.Duration) {
+	commandTimes = append(commandTimes, commandTime{filepath.Base(command), d.Seconds()})
+}
+
+// metrics are samples keyed by name and labels, in the order they were first seen.
+type metrics struct {
+	keys   []string
+	values map[string]float64
+}
+
+func (m *metrics) add(key string, v float64) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] += v
+}
+
+func (m *metrics) observe(name, labels string, v float64) {
+	for _, b := range durationBuckets {
+		n := 0.0
+		if v <= b {
+			n = 1
+		}
+		m.add(fmt.Sprintf("%s_bucket{%s,le=\"%s\"}", name, labels, strconv.FormatFloat(b, 'g', -1, 64)), n)
+	}
+	m.add(fmt.Sprintf("%s_bucket{%s,le=\"+Inf\"}", name, labels), 1)
+	m.add(fmt.Sprintf("%s_sum{%s}", name, labels), v)
+	m.add(fmt.Sprintf("%s_count{%s}", name, labels), 1)
+}
+
+func parseMetrics(data []byte) metrics {
+	m := metrics{values: map[string]float64{}}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		i := strings.LastIndex(line, " ")
+		if line == "" || strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		m.add(line[:i], v)
+	}
+	return m
+}
+
+func (m metrics) format() []byte {
+	var buf bytes.Buffer
+	for _, f := range metricFamilies {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, k := range m.keys {
+			name := k
+			if i := strings.Index(k, "{"); i >= 0 {
+				name = k[:i]
+			}
+			if name == f.name || (f.kind == "histogram" &&
+				(name == f.name+"_bucket" || name == f.name+"_sum" || name == f.name+"_count")) {
+				fmt.Fprintf(&buf, "%s %s\n", k, strconv.FormatFloat(m.values[k], 'g', -1, 64))
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+func label(name, value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return fmt.Sprintf("%s=\"%s\"", name, r.Replace(value))
+}
+
+// recordCall adds a finished call to the metrics file configured on the node.
+func recordCall(action string, ret int, d time.Duration) {
+	cfg, err := loadNodeConfig()
+	if err != nil || cfg.MetricsFile == "" {
+		return
+	}
+	if err := updateMetrics(cfg.MetricsFile, func(m *metrics) {
+		failed := ""
+		if ret != EXITSUCCESS {
+			failed = currentStep
+		}
+		m.add(fmt.Sprintf("linstor_flexvolume_calls_total{%s,%s,%s}",
+			label("action", action), label("exit_code", strconv.Itoa(ret)), label("step", failed)), 1)
+		m.observe("linstor_flexvolume_call_duration_seconds", label("action", action), d.Seconds())
+		for _, c := range commandTimes {
+			m.observe("linstor_flexvolume_command_duration_seconds", label("command", c.command), c.seconds)
+		}
+	}); err != nil {
+		log.Printf("couldn't update metrics in %s: %v", cfg.MetricsFile, err)
+	}
+}
+
+// updateMetrics applies update to the metrics in path. Concurrent driver
+// calls take turns through a lock file next to it, and the collector only
+// ever sees complete files, as a new file is renamed over the old one.
+func updateMetrics(path string, update func(*metrics)) error {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m := parseMetrics(data)
+	update(&m)
+
+	// The collector ignores files not ending in .prom, like the temp file.
+	return writeFileAtomic(path, m.format(), 0644)
+}
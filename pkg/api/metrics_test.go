@@ -0,0 +1,96 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMetrics(t *testing.T) {
+	var tableTests = []struct {
+		in     string
+		keys   []string
+		values map[string]float64
+	}{
+		{"", nil, map[string]float64{}},
+		{"# HELP x y\n# TYPE x counter\nx{a=\"1\"} 2\nx{a=\"2\"} 0.5\n",
+			[]string{`x{a="1"}`, `x{a="2"}`}, map[string]float64{`x{a="1"}`: 2, `x{a="2"}`: 0.5}},
+		// Label values may contain spaces, the value is after the last one.
+		{`x{step="a b"} 3` + "\n", []string{`x{step="a b"}`}, map[string]float64{`x{step="a b"}`: 3}},
+		// Samples seen twice add up, broken lines are skipped.
+		{"x 1\n\nx 2\ngarbage\ny NaN?\n  z 4  \n", []string{"x", "z"}, map[string]float64{"x": 3, "z": 4}},
+	}
+
+	for _, tt := range tableTests {
+		m := parseMetrics([]byte(tt.in))
+		if !reflect.DeepEqual(m.keys, tt.keys) || !reflect.DeepEqual(m.values, tt.values) {
+			t.Errorf("Expected %v %v for %q, got %v %v", tt.keys, tt.values, tt.in, m.keys, m.values)
+		}
+	}
+}
+
+func TestFormatMetrics(t *testing.T) {
+	m := metrics{values: map[string]float64{}}
+	m.observe("linstor_flexvolume_command_duration_seconds", label("command", "linstor"), 0.3)
+	m.add(`linstor_flexvolume_calls_total{action="attach",exit_code="0",step=""}`, 1)
+	m.add("unknown_metric", 1)
+	m.observe("linstor_flexvolume_command_duration_seconds", label("command", "linstor"), 7)
+
+	out := string(m.format())
+	for _, line := range []string{
+		"# TYPE linstor_flexvolume_calls_total counter",
+		`linstor_flexvolume_calls_total{action="attach",exit_code="0",step=""} 1`,
+		"# TYPE linstor_flexvolume_command_duration_seconds histogram",
+		`linstor_flexvolume_command_duration_seconds_bucket{command="linstor",le="0.25"} 0`,
+		`linstor_flexvolume_command_duration_seconds_bucket{command="linstor",le="0.5"} 1`,
+		`linstor_flexvolume_command_duration_seconds_bucket{command="linstor",le="10"} 2`,
+		`linstor_flexvolume_command_duration_seconds_bucket{command="linstor",le="+Inf"} 2`,
+		`linstor_flexvolume_command_duration_seconds_sum{command="linstor"} 7.3`,
+		`linstor_flexvolume_command_duration_seconds_count{command="linstor"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected line %q in\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "unknown_metric") {
+		t.Errorf("Expected metrics of unknown families to be dropped, got\n%s", out)
+	}
+	if strings.Index(out, "calls_total{") > strings.Index(out, "command_duration_seconds_bucket{") {
+		t.Errorf("Expected samples in the order of their families, got\n%s", out)
+	}
+
+	// What is written reads back the same.
+	back := parseMetrics(m.format())
+	if len(back.values) != len(m.values)-1 {
+		t.Errorf("Expected %d samples to read back, got %d", len(m.values)-1, len(back.values))
+	}
+	for k, v := range back.values {
+		if m.values[k] != v {
+			t.Errorf("Expected %s to read back as %g, got %g", k, m.values[k], v)
+		}
+	}
+}
+
+func TestLabel(t *testing.T) {
+	if l := label("step", "a\"b\\c\nd"); l != `step="a\"b\\c\nd"` {
+		t.Errorf(`Expected step="a\"b\\c\nd", got %s`, l)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// mountInfo is a single mount from the kernel's mount table.
+type mountInfo struct {
+	Source string
+	Target string
+	FSType string
+}
+
+// listMounts parses the kernel's mount table.
+func listMounts() ([]mountInfo, error) {
+	data, err := ioutil.ReadFile(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts []mountInfo
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		// The optional fields before the separator vary in number.
+		parts := strings.SplitN(line, " - ", 2)
+		pre, post := strings.Fields(parts[0]), []string{}
+		if len(parts) == 2 {
+			post = strings.Fields(parts[1])
+		}
+		if len(pre) < 5 || len(post) < 2 {
+			return nil, fmt.Errorf("couldn't parse mount table entry %q", line)
+		}
+		mounts = append(mounts, mountInfo{
+			Source: unescapeMountPath(post[1]),
+			Target: unescapeMountPath(pre[4]),
+			FSType: post[0],
+		})
+	}
+	return mounts, nil
+}
+
+// unescapeMountPath undoes the octal escaping of whitespace and backslashes
+// in the mount table.
+func unescapeMountPath(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// driverMounts returns the device mounts the driver made below dir, one per volume.
+func driverMounts(dir string) ([]mountInfo, error) {
+	all, err := listMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts []mountInfo
+	for _, m := range all {
+		if filepath.Dir(m.Target) == dir {
+			mounts = append(mounts, m)
+		}
+	}
+	return mounts, nil
+}
+
+// mountedVolume returns the resource and volume mounted at path on this node.
+// It asks DRBD rather than the controller, so unmounts are not held up by a
+// controller that can't be reached.
+func mountedVolume(path string) (string, int, error) {
+	mounts, err := listMounts()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var device string
+	for _, m := range mounts {
+		if m.Target == path {
+			device = m.Source
+		}
+	}
+	if device == "" {
+		return "", 0, fmt.Errorf("nothing mounted at %s", path)
+	}
+	return drbdVolumeOf(device)
+}
+
+// podMount parses a bind mount kubelet made of a volume of this driver into
+// a pod, which are at <kubelet>/pods/<pod uid>/volumes/linbit~linstor-flexvolume/<volume>.
+func podMount(cfg nodeConfig, target string) (podUID, volume string, ok bool) {
+	rel, err := filepath.Rel(filepath.Join(cfg.KubeletDir, "pods"), target)
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) != 4 || parts[0] == ".." || parts[1] != "volumes" || parts[2] != pluginDirName {
+		return "", "", false
+	}
+	return parts[0], parts[3], true
+}
+
+// bindMount mounts source at target, unless something is mounted there
+// already.
+func bindMount(source, target string) error {
+	mounts, err := listMounts()
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if m.Target == target {
+			return nil
+		}
+	}
+	if out, err := change("mkdir", "-p", target); err != nil {
+		return fmt.Errorf("unable to create %s: %v: %s", target, err, out)
+	}
+	if out, err := change("mount", "--bind", source, target); err != nil {
+		return fmt.Errorf("unable to bind mount %s at %s: %v: %s", source, target, err, out)
+	}
+	return nil
+}
+
+// sameDevice compares device paths by what they point to.
+func sameDevice(a, b string) bool {
+	if p, err := filepath.EvalSymlinks(a); err == nil {
+		a = p
+	}
+	if p, err := filepath.EvalSymlinks(b); err == nil {
+		b = p
+	}
+	return a == b
+}
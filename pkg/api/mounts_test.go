@@ -0,0 +1,75 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import "testing"
+
+func TestUnescapeMountPath(t *testing.T) {
+	var tableTests = []struct {
+		in       string
+		expected string
+	}{
+		{"/mnt/data", "/mnt/data"},
+		{`/mnt/my\040data`, "/mnt/my data"},
+		{`/mnt/tab\011and\012newline`, "/mnt/tab\tand\nnewline"},
+		{`/mnt/back\134slash`, `/mnt/back\slash`},
+		{`\040`, " "},
+		{`/mnt/end\040`, "/mnt/end "},
+		// Anything but three octal digits is taken as it is.
+		{`/mnt/short\04`, `/mnt/short\04`},
+		{`/mnt/not\08octal`, `/mnt/not\08octal`},
+		{`/mnt/too\777big`, `/mnt/too\777big`},
+		{`/mnt/trailing\`, `/mnt/trailing\`},
+		{"", ""},
+	}
+
+	for _, tt := range tableTests {
+		if out := unescapeMountPath(tt.in); out != tt.expected {
+			t.Errorf("Expected %q for %q, got %q", tt.expected, tt.in, out)
+		}
+	}
+}
+
+func TestPodMount(t *testing.T) {
+	cfg := nodeConfig{KubeletDir: "/var/lib/kubelet"}
+
+	var tableTests = []struct {
+		target string
+		pod    string
+		volume string
+		ok     bool
+	}{
+		{"/var/lib/kubelet/pods/uid/volumes/linbit~linstor-flexvolume/data", "uid", "data", true},
+		{"/var/lib/kubelet/pods/uid/volumes/linbit~linstor-flexvolume/data/", "uid", "data", true},
+		{"/var/lib/kubelet/pods/uid/volumes/kubernetes.io~empty-dir/data", "", "", false},
+		{"/var/lib/kubelet/pods/uid/volumes/linbit~linstor-flexvolume", "", "", false},
+		{"/var/lib/kubelet/pods/uid/volumes/linbit~linstor-flexvolume/data/sub", "", "", false},
+		{"/var/lib/kubelet/pods/uid/volume-subpaths/linbit~linstor-flexvolume/data", "", "", false},
+		{"/var/lib/kubelet/plugins/linbit/linstor-flexvolume/mounts/data", "", "", false},
+		{"/var/lib/other/pods/uid/volumes/linbit~linstor-flexvolume/data", "", "", false},
+		{"pods/uid/volumes/linbit~linstor-flexvolume/data", "", "", false},
+	}
+
+	for _, tt := range tableTests {
+		pod, volume, ok := podMount(cfg, tt.target)
+		if ok != tt.ok || pod != tt.pod || volume != tt.volume {
+			t.Errorf("Expected %q %q %t for %s, got %q %q %t", tt.pod, tt.volume, tt.ok, tt.target, pod, volume, ok)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	linstor "github.com/LINBIT/golinstor"
+)
+
+// The resource a resource was cloned or restored from. Its filesystem is
+// still bound to that resource until it's mounted for the first time.
+const fsOriginProp = auxPrefix + "fs-origin"
+
+// provision creates the volume's resource if it doesn't exist yet and is
+// meant to be created by the driver: ephemeral volumes and volumes with a
+// source to create them from. The resource definition is tagged as soon as
+// it exists, so that an attach failing halfway leaves nothing behind that
+// detach and ephemeral cleanup can't find.
+func provision(c linstorClient, opts options, node string) error {
+	if !opts.ephemeral && opts.FromSnapshot == "" && opts.CloneOf == "" {
+		return nil
+	}
+
+	name := opts.getResource(node)
+
+	defs, err := c.resourceDefinitions()
+	if err != nil {
+		return err
+	}
+	for _, def := range defs {
+		if def.RscName != name {
+			continue
+		}
+		if !opts.ephemeral {
+			return nil
+		}
+		exists, err := resumeEphemeral(c, def, opts, node)
+		if err != nil || exists {
+			return err
+		}
+	}
+
+	props := map[string]string{}
+	if opts.ephemeral {
+		props = ephemeralProps(opts, node)
+	}
+
+	if opts.FromSnapshot != "" || opts.CloneOf != "" {
+		return provisionFromSource(c, opts, name, props)
+	}
+
+	p := opts.placement()
+	r := linstor.NewResourceDeployment(linstor.ResourceDeploymentConfig{
+		Name:                name,
+		NodeList:            opts.nodeList,
+		AutoPlace:           p.replicas,
+		ReplicasOnSame:      p.same,
+		ReplicasOnDifferent: p.different,
+		DoNotPlaceWithRegex: opts.DoNotPlaceWithRegex,
+		SizeKiB:             opts.sizeKiB,
+		StoragePool:         opts.StoragePool,
+		Encryption:          opts.encryptVolumes,
+		Controllers:         c.controllers,
+		LogOut:              logOutput,
+	})
+	p.replicas = r.AutoPlace
+	_, err = checkCapacity(c, r.StoragePool, r.SizeKiB, opts.overProvisionRatio, r.NodeList, nil, p)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("creating ephemeral resource %s for volume %s on node %s", name, opts.volumeName(), node)
+	if err := c.do("resource-definition", "create", name); err != nil {
+		return fmt.Errorf("unable to create resource definition %s: %v", name, err)
+	}
+	if err := c.setResourceDefinitionProps(name, props); err != nil {
+		return err
+	}
+	if err := createAndAssign(c, r); err != nil {
+		if len(r.NodeList) == 0 {
+			return fmt.Errorf("unable to auto-place %s in storage pool %s: %v", p, r.StoragePool, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// ephemeralProps returns the properties an ephemeral resource is tagged with.
+func ephemeralProps(opts options, node string) map[string]string {
+	return map[string]string{
+		ephemeralProp:        "true",
+		ephemeralNodeProp:    node,
+		ephemeralVolumeProp:  opts.volumeName(),
+		ephemeralGraceProp:   opts.ephemeralGrace.String(),
+		ephemeralCreatedProp: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// resumeEphemeral takes over the existing definition of an ephemeral
+// resource. One that was detached is attached again. One that an earlier
+// attach left behind before it was tagged is tagged, and one it left behind
+// before deploying it, holding no data yet, is deleted to be created anew.
+// It returns whether the resource still exists.
+func resumeEphemeral(c linstorClient, def resDef, opts options, node string) (bool, error) {
+	if def.RscDfnProps.get(ephemeralDetachedProp) != "" {
+		log.Printf("ephemeral resource %s attached again", def.RscName)
+		return true, c.setResourceDefinitionProps(def.RscName, map[string]string{ephemeralDetachedProp: ""})
+	}
+
+	res, err := c.resources()
+	if err != nil {
+		return true, err
+	}
+	deployed := false
+	for _, r := range res {
+		deployed = deployed || r.Name == def.RscName
+	}
+
+	if !deployed || def.hasVolume(0) != nil {
+		log.Printf("deleting ephemeral resource %s left behind by an earlier attach", def.RscName)
+		r := linstor.NewResourceDeployment(linstor.ResourceDeploymentConfig{
+			Name:        def.RscName,
+			Controllers: c.controllers,
+			LogOut:      logOutput,
+		})
+		return false, deleteResource(c, r)
+	}
+
+	if def.RscDfnProps.get(ephemeralProp) != "true" {
+		log.Printf("tagging ephemeral resource %s left behind by an earlier attach", def.RscName)
+		return true, c.setResourceDefinitionProps(def.RscName, ephemeralProps(opts, node))
+	}
+	return true, nil
+}
+
+// provisionFromSource restores the resource name from the snapshot or clone
+// source in the options, tagging it with props and the source it came from.
+func provisionFromSource(c linstorClient, opts options, name string, props map[string]string) error {
+	var source, snapshot string
+	if opts.FromSnapshot != "" {
+		source, snapshot = opts.fromSnapshot[0], opts.fromSnapshot[1]
+		log.Printf("creating resource %s from snapshot %s of resource %s", name, snapshot, source)
+	} else {
+		// Clones are restored from a snapshot taken just for them.
+		source, snapshot = opts.CloneOf, "clone-for-"+name
+		log.Printf("creating resource %s as a clone of resource %s", name, source)
+	}
+
+	// Checked before a snapshot is taken for a clone, so a clone that
+	// doesn't fit leaves none behind.
+	sizeKiB, holding, err := snapshotSize(c, source, snapshot, opts.CloneOf != "")
+	if err != nil {
+		return err
+	}
+	nodes, err := restoreNodes(c, source, sizeKiB, holding, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.CloneOf != "" {
+		// A snapshot left behind by an earlier attempt is taken again, so
+		// the clone gets the data the source has now. If it can't be
+		// deleted, it is used as it is.
+		found, err := c.hasSnapshot(source, snapshot)
+		if err != nil {
+			return err
+		}
+		if found {
+			if err := c.deleteSnapshot(source, snapshot); err != nil {
+				log.Printf("reusing snapshot %s of resource %s left behind by an earlier attempt: %v", snapshot, source, err)
+			} else {
+				found = false
+			}
+		}
+		if !found {
+			if err := c.createSnapshot(source, snapshot); err != nil {
+				return err
+			}
+		}
+	}
+
+	props[fsOriginProp] = source
+	if err := c.restoreSnapshot(source, snapshot, name, nodes, props); err != nil {
+		return err
+	}
+
+	if opts.CloneOf != "" {
+		// Some storage pools, like ZFS, keep restored volumes dependent
+		// on the snapshot, it has to stay around then.
+		if err := c.deleteSnapshot(source, snapshot); err != nil {
+			log.Printf("keeping snapshot %s of resource %s: %v", snapshot, source, err)
+		}
+	}
+
+	return nil
+}
+
+// snapshotSize returns the size of a snapshot of resource and the nodes
+// holding it. For a clone, whose snapshot is yet to be taken, that's the size
+// of the resource and the nodes with a replica of it.
+func snapshotSize(c linstorClient, resource, snapshot string, clone bool) (uint64, []string, error) {
+	var sizeKiB uint64
+	var holding []string
+
+	if clone {
+		def, err := c.resourceDefinition(resource)
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, v := range def.VlmDfns {
+			sizeKiB += uint64(v.VlmSize)
+		}
+		res, err := c.resources()
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, r := range res {
+			if r.Name == resource && !r.diskless() {
+				holding = append(holding, r.NodeName)
+			}
+		}
+		return sizeKiB, holding, nil
+	}
+
+	snaps, err := c.snapshots()
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, s := range snaps {
+		if s.RscName != resource || s.SnapshotName != snapshot {
+			continue
+		}
+		for _, v := range s.SnapshotVlmDfns {
+			sizeKiB += uint64(v.VlmSize)
+		}
+		for _, sn := range s.Snapshots {
+			holding = append(holding, sn.NodeName)
+		}
+		return sizeKiB, holding, nil
+	}
+	return 0, nil, fmt.Errorf("snapshot %s of resource %s not found", snapshot, resource)
+}
+
+// restoreNodes selects the nodes to restore a snapshot of sizeKiB to,
+// checking that their storage pools have room for it: the ones in the
+// nodeList option, or as many of the nodes holding the snapshot as autoPlace
+// asks for, following replicasOnSame and replicasOnDifferent. Without either,
+// it's restored to all of them and no nodes are returned.
+func restoreNodes(c linstorClient, resource string, sizeKiB uint64, holding []string, opts options) ([]string, error) {
+	pool, err := sourcePool(c, resource, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.nodeList) == 0 && opts.autoPlace == 0 {
+		if len(holding) != 0 {
+			_, err = checkCapacity(c, pool, sizeKiB, opts.overProvisionRatio, holding, nil, placement{})
+		}
+		return nil, err
+	}
+	if len(opts.nodeList) == 0 && len(holding) == 0 {
+		return nil, fmt.Errorf("no node holds the data of resource %s to restore", resource)
+	}
+	return checkCapacity(c, pool, sizeKiB, opts.overProvisionRatio, opts.nodeList, holding, opts.placement())
+}
+
+// sourcePool returns the storage pool that restores of snapshots of resource
+// go to, the one its replicas are in. Without replicas left, that's the pool
+// from the options.
+func sourcePool(c linstorClient, resource string, opts options) (string, error) {
+	res, err := c.resources()
+	if err != nil {
+		return "", err
+	}
+	for _, r := range res {
+		if r.Name != resource || r.diskless() {
+			continue
+		}
+		for _, v := range r.Vlms {
+			return v.StorPoolName, nil
+		}
+	}
+	if opts.StoragePool == "" {
+		return "DfltStorPool", nil
+	}
+	return opts.StoragePool, nil
+}
+
+var sizeUnits = map[string]uint64{
+	"":   1,
+	"K":  1000,
+	"M":  1000 * 1000,
+	"G":  1000 * 1000 * 1000,
+	"T":  1000 * 1000 * 1000 * 1000,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+}
+
+// parseSizeKiB parses a size in bytes with an optional Kubernetes style unit
+// suffix such as 10Gi, rounded up to KiB.
+func parseSizeKiB(s string) (uint64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseUint(s[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+	unit, ok := sizeUnits[s[i:]]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", s, s[i:])
+	}
+	if n > (math.MaxUint64-1023)/unit {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return (n*unit + 1023) / 1024, nil
+}
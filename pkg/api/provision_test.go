@@ -0,0 +1,63 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import "testing"
+
+func TestParseSizeKiB(t *testing.T) {
+	var tableTests = []struct {
+		in  string
+		kib uint64
+		ok  bool
+	}{
+		{"0", 0, true},
+		{"1", 1, true},
+		{"1024", 1, true},
+		{"1025", 2, true},
+		{"1Ki", 1, true},
+		{"1Mi", 1024, true},
+		{"10Gi", 10 << 20, true},
+		{"1Ti", 1 << 30, true},
+		{"1K", 1, true},
+		{"1M", 977, true},
+		{"2G", 1953125, true},
+		{"1T", 976562500, true},
+		{"", 0, false},
+		{"Gi", 0, false},
+		{"-1Gi", 0, false},
+		{"1.5Gi", 0, false},
+		{"1gi", 0, false},
+		{"1GiB", 0, false},
+		{"1 Gi", 0, false},
+		{"16777215Ti", 18014397435740160, true},
+		{"16777216Ti", 0, false},
+		{"18446744073709551616", 0, false},
+	}
+
+	for _, tt := range tableTests {
+		kib, err := parseSizeKiB(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Expected ok %t for %q, got %v", tt.ok, tt.in, err)
+			continue
+		}
+		if kib != tt.kib {
+			t.Errorf("Expected %d KiB for %q, got %d", tt.kib, tt.in, kib)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// LINSTOR calls that fail because the controller is briefly away, such as
+// while it restarts, are retried until the call's retry budget is used up.
+const (
+	defaultRetryBudget = 30 * time.Second
+	firstRetryDelay    = 500 * time.Millisecond
+	maxRetryDelay      = 8 * time.Second
+)
+
+// Until when the running call may retry.
+var retryDeadline time.Time
+
+// Failures the controller answered with a return status are sorted by its
+// code. For the others, these say the request can't succeed. They are checked
+// first, a message naming the controller connection may still be about, say,
+// a missing resource.
+var permanentErrors = []string{
+	"not found",
+	"not exist",
+	"invalid",
+	"no space",
+	"not enough free space",
+	"not enough nodes",
+	"already exists",
+	"unable to place",
+}
+
+// Failures that say the controller could not answer right now, besides it
+// not being reachable at all.
+var transientErrors = []string{
+	"connection reset",
+	"timed out",
+	"timeout",
+	"busy",
+	"temporarily unavailable",
+	"try again",
+	"controller is not connected",
+	"broken pipe",
+}
+
+// retryBudget returns how long calls may retry, from the node config.
+func retryBudget() time.Duration {
+	cfg, err := loadNodeConfig()
+	if err != nil || cfg.RetryBudget == "" {
+		return defaultRetryBudget
+	}
+	d, err := time.ParseDuration(cfg.RetryBudget)
+	if err != nil {
+		log.Printf("ignoring retryBudget %q: %v", cfg.RetryBudget, err)
+		return defaultRetryBudget
+	}
+	return d
+}
+
+// transient sorts an error from LINSTOR into one that may go away when
+// tried again, or not. An answer from the controller is final, anything
+// unknown counts as permanent.
+func transient(err error) bool {
+	if _, ok := retCodeOf(err); ok {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range permanentErrors {
+		if strings.Contains(msg, s) {
+			return false
+		}
+	}
+	for _, s := range transientErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return unreachable(err)
+}
+
+// retry calls f until it succeeds, fails permanently, or the next attempt
+// would not start before the retry deadline. Delays double from attempt to
+// attempt, up to a maximum.
+func retry(what string, f func() error) error {
+	return retryIf(what, transient, f)
+}
+
+// retryMutation is retry for requests that change something. They are only
+// sent again if they never got to the controller, one that timed out may
+// have been carried out all the same.
+func retryMutation(what string, f func() error) error {
+	return retryIf(what, unreachable, f)
+}
+
+func retryIf(what string, again func(error) bool, f func() error) error {
+	delay := firstRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !again(err) || time.Now().Add(delay).After(retryDeadline) {
+			return err
+		}
+		log.Printf("%s failed, retry %d in %s: %v", what, attempt, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const snapshotUsage = "snapshot create <resource> [<snapshot>] | list [<resource>] | " +
+	"delete <resource> <snapshot> | restore <resource> <snapshot> <new resource>"
+
+type snapshotInfo struct {
+	Resource string   `json:"resource"`
+	Snapshot string   `json:"snapshot"`
+	Nodes    []string `json:"nodes"`
+	OnNode   bool     `json:"onNode"`
+	SizeKiB  int64    `json:"sizeKiB"`
+	State    string   `json:"state"`
+}
+
+type snapshotResponse struct {
+	response
+	Snapshots []snapshotInfo `json:"snapshots,omitempty"`
+}
+
+// snapshot manages snapshots of the resources used by the driver. Resources
+// may be named by their LINSTOR or PV name.
+func (api FlexVolumeApi) snapshot(args []string) (string, int) {
+	flags := api.newFlagSet()
+	output := outputFlag(flags)
+	controllers := flags.String("controllers", "", "LINSTOR controllers, overrides the node config")
+	if err := flags.Parse(args); err != nil {
+		return api.fmtAPIError(err)
+	}
+	if err := checkOutputFormat(*output); err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	args = flags.Args()
+	if len(args) < 1 {
+		return api.fmtAPIError(fmt.Errorf("usage: %s", snapshotUsage))
+	}
+
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	localNode, err := cfg.localNode()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	c := adminClient(cfg, *controllers)
+
+	cmd, args := args[0], args[1:]
+
+	// All but list need a resource, resolve it up front.
+	var resource string
+	if len(args) > 0 {
+		def, err := c.resolveResource(args[0])
+		if err != nil {
+			return api.fmtAPIError(err)
+		}
+		resource = def.RscName
+	}
+
+	resp := snapshotResponse{response: response{Status: "Success"}}
+
+	switch {
+	case cmd == "create" && len(args) >= 1:
+		snap := "snapshot-" + time.Now().UTC().Format("20060102-150405")
+		if len(args) > 1 {
+			snap = args[1]
+		}
+		if err := c.createSnapshot(resource, snap); err != nil {
+			return api.fmtAPIError(err)
+		}
+		resp.Message = fmt.Sprintf("created snapshot %s of resource %s", snap, resource)
+	case cmd == "list":
+		snaps, err := c.snapshots()
+		if err != nil {
+			return api.fmtAPIError(err)
+		}
+		resp.Snapshots = []snapshotInfo{}
+		for _, s := range snaps {
+			if resource == "" || s.RscName == resource {
+				resp.Snapshots = append(resp.Snapshots, newSnapshotInfo(s, localNode))
+			}
+		}
+	case cmd == "delete" && len(args) >= 2:
+		if err := c.deleteSnapshot(resource, args[1]); err != nil {
+			return api.fmtAPIError(err)
+		}
+		resp.Message = fmt.Sprintf("deleted snapshot %s of resource %s", args[1], resource)
+	case cmd == "restore" && len(args) >= 3:
+		if err := c.restoreSnapshot(resource, args[1], args[2], nil, nil); err != nil {
+			return api.fmtAPIError(err)
+		}
+		resp.Message = fmt.Sprintf("restored snapshot %s of resource %s to resource %s", args[1], resource, args[2])
+	default:
+		return api.fmtAPIError(fmt.Errorf("usage: %s", snapshotUsage))
+	}
+
+	if *output == "json" {
+		res, _ := json.Marshal(resp)
+		return string(res), EXITSUCCESS
+	}
+
+	if cmd != "list" {
+		return resp.Message + "\n", EXITSUCCESS
+	}
+
+	rows := [][]string{}
+	for _, s := range resp.Snapshots {
+		rows = append(rows, []string{
+			s.Resource, s.Snapshot, strings.Join(s.Nodes, ","),
+			strconv.FormatBool(s.OnNode), strconv.FormatInt(s.SizeKiB, 10), s.State,
+		})
+	}
+	return formatTable([]string{"RESOURCE", "SNAPSHOT", "NODES", "LOCAL", "SIZE (KiB)", "STATE"}, rows), EXITSUCCESS
+}
+
+func newSnapshotInfo(s snapshotDef, localNode string) snapshotInfo {
+	info := snapshotInfo{
+		Resource: s.RscName,
+		Snapshot: s.SnapshotName,
+		Nodes:    []string{},
+		State:    strings.Join(s.Flags, ","),
+	}
+	for _, n := range s.Snapshots {
+		info.Nodes = append(info.Nodes, n.NodeName)
+		if n.NodeName == localNode {
+			info.OnNode = true
+		}
+	}
+	sort.Strings(info.Nodes)
+	for _, v := range s.SnapshotVlmDfns {
+		info.SizeKiB += v.VlmSize
+	}
+	return info
+}
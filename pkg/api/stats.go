@@ -0,0 +1,130 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"syscall"
+)
+
+type linstorStats struct {
+	Resource string `json:"resource"`
+	Volume   int    `json:"volume"`
+	// Space taken in the storage pool by the largest replica, if the
+	// satellites report it.
+	AllocatedBytes *int64 `json:"allocatedBytes,omitempty"`
+	Thin           bool   `json:"thin"`
+	// Data not yet in sync with the most out of date replica, if the
+	// satellites report it.
+	OutOfSyncBytes *int64 `json:"outOfSyncBytes,omitempty"`
+}
+
+type statsResponse struct {
+	response
+	CapacityBytes  int64         `json:"capacityBytes"`
+	UsedBytes      int64         `json:"usedBytes"`
+	AvailableBytes int64         `json:"availableBytes"`
+	Inodes         int64         `json:"inodes"`
+	InodesUsed     int64         `json:"inodesUsed"`
+	InodesFree     int64         `json:"inodesFree"`
+	Linstor        *linstorStats `json:"linstor,omitempty"`
+}
+
+// stats reports the usage of the filesystem mounted at path and, if that
+// is a LINSTOR volume, what it takes up in LINSTOR.
+func (api FlexVolumeApi) stats(path string) (string, int) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return api.fmtAPIError(fmt.Errorf("couldn't stat filesystem at %s: %v", path, err))
+	}
+
+	bsize := int64(fs.Bsize)
+	resp := statsResponse{
+		response:       response{Status: "Success"},
+		CapacityBytes:  int64(fs.Blocks) * bsize,
+		UsedBytes:      int64(fs.Blocks-fs.Bfree) * bsize,
+		AvailableBytes: int64(fs.Bavail) * bsize,
+		Inodes:         int64(fs.Files),
+		InodesUsed:     int64(fs.Files - fs.Ffree),
+		InodesFree:     int64(fs.Ffree),
+	}
+
+	// The filesystem statistics are what kubelet needs, LINSTOR's view is a
+	// bonus that is left out if LINSTOR can't be asked.
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	c := cfg.client(cfg.Controllers)
+	resource, volume, err := mountedVolume(path)
+	if err == nil {
+		resp.Linstor, err = volumeStats(c, resource, volume)
+	}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+
+	res, _ := json.Marshal(resp)
+	return string(res), EXITSUCCESS
+}
+
+func volumeStats(c linstorClient, resource string, volume int) (*linstorStats, error) {
+	res, states, err := c.resourcesWithStates()
+	if err != nil {
+		return nil, err
+	}
+	pools, err := c.storagePools()
+	if err != nil {
+		return nil, err
+	}
+
+	st := &linstorStats{Resource: resource, Volume: volume}
+	for _, r := range res {
+		if r.Name != resource || r.diskless() {
+			continue
+		}
+		for _, v := range r.Vlms {
+			if v.VlmNr != volume {
+				continue
+			}
+			if v.AllocatedSize != nil && (st.AllocatedBytes == nil || *v.AllocatedSize*1024 > *st.AllocatedBytes) {
+				b := *v.AllocatedSize * 1024
+				st.AllocatedBytes = &b
+			}
+			for _, p := range pools {
+				if p.NodeName == r.NodeName && p.StorPoolName == v.StorPoolName && p.thin() {
+					st.Thin = true
+				}
+			}
+		}
+	}
+	for _, s := range states {
+		if s.RscName != resource {
+			continue
+		}
+		for _, v := range s.VlmStates {
+			if v.VlmNr == volume && v.OutOfSync != nil && (st.OutOfSyncBytes == nil || *v.OutOfSync*1024 > *st.OutOfSyncBytes) {
+				b := *v.OutOfSync * 1024
+				st.OutOfSyncBytes = &b
+			}
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,159 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+type podVolume struct {
+	PodUID string `json:"podUID"`
+	Volume string `json:"volume"`
+	Path   string `json:"path"`
+}
+
+type volumeStatus struct {
+	Resource    string      `json:"resource"`
+	Volume      int         `json:"volume"`
+	Diskless    bool        `json:"diskless"`
+	Device      string      `json:"device"`
+	DiskState   string      `json:"diskState"`
+	GlobalMount string      `json:"globalMount,omitempty"`
+	Pods        []podVolume `json:"pods"`
+}
+
+type statusResponse struct {
+	response
+	Node    string         `json:"node"`
+	Volumes []volumeStatus `json:"volumes"`
+}
+
+// localVolumes returns every LINSTOR volume assigned to this node, along with
+// where kubelet has it mounted.
+func localVolumes(c linstorClient, cfg nodeConfig, node string) ([]volumeStatus, error) {
+	res, states, err := c.resourcesWithStates()
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := listMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	vols := []volumeStatus{}
+	for _, r := range res {
+		if r.NodeName != node {
+			continue
+		}
+		for _, v := range r.Vlms {
+			st := volumeStatus{
+				Resource:  r.Name,
+				Volume:    v.VlmNr,
+				Diskless:  r.diskless(),
+				Device:    v.DevicePath,
+				DiskState: "Unknown",
+				Pods:      []podVolume{},
+			}
+			for _, s := range states {
+				if s.RscName != r.Name || s.NodeName != node {
+					continue
+				}
+				for _, vs := range s.VlmStates {
+					if vs.VlmNr == v.VlmNr && vs.DiskState != "" {
+						st.DiskState = vs.DiskState
+					}
+				}
+			}
+			for _, m := range mounts {
+				if v.DevicePath == "" || !sameDevice(m.Source, v.DevicePath) {
+					continue
+				}
+				if filepath.Dir(m.Target) == cfg.mountsDir() {
+					st.GlobalMount = m.Target
+				} else if uid, name, ok := podMount(cfg, m.Target); ok {
+					st.Pods = append(st.Pods, podVolume{PodUID: uid, Volume: name, Path: m.Target})
+				}
+			}
+			vols = append(vols, st)
+		}
+	}
+
+	sort.Slice(vols, func(i, j int) bool {
+		if vols[i].Resource != vols[j].Resource {
+			return vols[i].Resource < vols[j].Resource
+		}
+		return vols[i].Volume < vols[j].Volume
+	})
+	return vols, nil
+}
+
+// status lists the LINSTOR volumes on this node and the pods using them.
+func (api FlexVolumeApi) status(args []string) (string, int) {
+	flags := api.newFlagSet()
+	output := outputFlag(flags)
+	controllers := flags.String("controllers", "", "LINSTOR controllers, overrides the node config")
+	if err := flags.Parse(args); err != nil {
+		return api.fmtAPIError(err)
+	}
+	if err := checkOutputFormat(*output); err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	node, err := cfg.localNode()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	vols, err := localVolumes(adminClient(cfg, *controllers), cfg, node)
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	if *output == "json" {
+		res, _ := json.Marshal(statusResponse{
+			response: response{Status: "Success"},
+			Node:     node,
+			Volumes:  vols,
+		})
+		return string(res), EXITSUCCESS
+	}
+
+	rows := [][]string{}
+	for _, v := range vols {
+		kind := "diskful"
+		if v.Diskless {
+			kind = "diskless"
+		}
+		row := []string{v.Resource, strconv.Itoa(v.Volume), kind, v.Device, v.DiskState, v.GlobalMount}
+		if len(v.Pods) == 0 {
+			rows = append(rows, append(row, "", ""))
+		}
+		for _, p := range v.Pods {
+			rows = append(rows, append(row[:len(row):len(row)], p.PodUID, p.Volume))
+		}
+	}
+	return formatTable([]string{"RESOURCE", "VOLUME", "TYPE", "DEVICE", "STATE", "MOUNT", "POD", "POD VOLUME"}, rows), EXITSUCCESS
+}
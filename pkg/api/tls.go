@@ -0,0 +1,261 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// The port controllers listen on for SSL connections by default.
+const defaultSSLPort = "3371"
+
+// The linstor client talks to the controller on localhost if none is given,
+// and then in plain text.
+const defaultController = "localhost"
+
+const tlsDialTimeout = 5 * time.Second
+
+// tlsSettings configure TLS, and client certificate authentication, to the
+// controllers. They come from the node config and can be overridden per
+// volume. The linstor client only takes the certificate files, ServerName and
+// MinVersion are enforced by the driver's own handshake with every
+// controller before the client is run against it.
+type tlsSettings struct {
+	CAFile     string `json:"caFile"`
+	CertFile   string `json:"certFile"`
+	KeyFile    string `json:"keyFile"`
+	ServerName string `json:"serverName"`
+	MinVersion string `json:"minVersion"`
+}
+
+func (t tlsSettings) enabled() bool {
+	return t != tlsSettings{}
+}
+
+// merge returns t with the settings that are set in o replaced.
+func (t tlsSettings) merge(o tlsSettings) tlsSettings {
+	if o.CAFile != "" {
+		t.CAFile = o.CAFile
+	}
+	if o.CertFile != "" {
+		t.CertFile = o.CertFile
+	}
+	if o.KeyFile != "" {
+		t.KeyFile = o.KeyFile
+	}
+	if o.ServerName != "" {
+		t.ServerName = o.ServerName
+	}
+	if o.MinVersion != "" {
+		t.MinVersion = o.MinVersion
+	}
+	return t
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// config builds the TLS client config from the settings.
+func (t tlsSettings) config() (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: t.ServerName, MinVersion: tls.VersionTLS12}
+
+	if t.MinVersion != "" {
+		v, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("minimum TLS version must be 1.0, 1.1, 1.2 or 1.3, not %q", t.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read CA bundle: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in CA bundle %s", t.CAFile)
+		}
+	}
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, fmt.Errorf("client certificate and key have to be set together")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load client certificate %s with key %s: %v", t.CertFile, t.KeyFile, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// args returns the linstor client arguments for the certificate files.
+func (t tlsSettings) args() []string {
+	var a []string
+	if t.CAFile != "" {
+		a = append(a, "--cafile", t.CAFile)
+	}
+	if t.CertFile != "" {
+		a = append(a, "--certfile", t.CertFile, "--keyfile", t.KeyFile)
+	}
+	return a
+}
+
+// tlsControllers returns the controllers c talks to, naming the default one
+// with TLS, so that it is not asked in plain text.
+func (c linstorClient) tlsControllers() string {
+	if c.controllers == "" && c.tls.enabled() {
+		return defaultController
+	}
+	return c.controllers
+}
+
+// sslController turns a controller address into one the linstor client
+// connects to with SSL.
+func sslController(controller string) string {
+	if strings.Contains(controller, "://") {
+		return controller
+	}
+	return "linstor+ssl://" + controller
+}
+
+// controllerAddr returns host:port of a controller for SSL connections.
+func controllerAddr(controller string) string {
+	if i := strings.Index(controller, "://"); i >= 0 {
+		controller = controller[i+3:]
+	}
+	if _, _, err := net.SplitHostPort(controller); err != nil {
+		return net.JoinHostPort(strings.Trim(controller, "[]"), defaultSSLPort)
+	}
+	return controller
+}
+
+// Controllers whose TLS setup was checked during this call.
+var tlsChecked = map[string]bool{}
+
+// checkTLS connects to controller with the TLS settings and explains what is
+// wrong with the certificates, if anything. The linstor client doesn't know
+// about server names and minimum versions, and its certificate errors are
+// hard to read, so every controller is checked by the driver before the
+// client is run against it: a controller whose certificate is not valid for
+// the server name, or that can't speak the minimum version, is refused.
+// Errors connecting at all are returned as they are.
+func checkTLS(t tlsSettings, controller string) error {
+	if tlsChecked[controller] {
+		return nil
+	}
+
+	cfg, err := t.config()
+	if err != nil {
+		return apiError{codeTLSFailed, err}
+	}
+	addr := controllerAddr(controller)
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: tlsDialTimeout}, "tcp", addr, cfg)
+	if err == nil {
+		err = awaitRejection(conn)
+		conn.Close()
+	}
+	if err != nil {
+		return explainTLSError(controller, cfg, t, err)
+	}
+
+	tlsChecked[controller] = true
+	return nil
+}
+
+// awaitRejection waits briefly for the controller to reject the client
+// certificate. With TLS 1.3 the client finishes the handshake before the
+// server has checked its certificate, or that it sent one at all.
+func awaitRejection(conn *tls.Conn) error {
+	if conn.ConnectionState().Version != tls.VersionTLS13 {
+		return nil
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	var netErr net.Error
+	if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return nil
+	}
+	return err
+}
+
+func explainTLSError(controller string, cfg *tls.Config, t tlsSettings, err error) error {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		header           tls.RecordHeaderError
+		netErr           net.Error
+	)
+	msg := err.Error()
+
+	switch {
+	case errors.As(err, &unknownAuthority):
+		ca := "the system CAs"
+		if t.CAFile != "" {
+			ca = t.CAFile
+		}
+		err = fmt.Errorf("certificate of controller %s is not signed by a CA in %s: %v", controller, ca, err)
+	case errors.As(err, &hostname):
+		err = fmt.Errorf("certificate of controller %s is not valid for %q, set serverName to a name it is valid for: %v",
+			controller, cfg.ServerName, err)
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		err = fmt.Errorf("certificate of controller %s has expired or is not valid yet: %v", controller, err)
+	case errors.As(err, &invalid):
+		err = fmt.Errorf("certificate of controller %s is invalid: %v", controller, err)
+	case errors.As(err, &header):
+		err = fmt.Errorf("controller %s did not answer with TLS, check that it listens for SSL on %s",
+			controller, controllerAddr(controller))
+	case strings.Contains(msg, "protocol version"):
+		min := t.MinVersion
+		if min == "" {
+			min = "1.2"
+		}
+		err = fmt.Errorf("controller %s does not support TLS %s or later: %v", controller, min, err)
+	case strings.Contains(msg, "remote error"):
+		cert := "no client certificate"
+		if t.CertFile != "" {
+			cert = "client certificate " + t.CertFile
+		}
+		err = fmt.Errorf("controller %s rejected the TLS connection with %s: %v", controller, cert, err)
+	case errors.As(err, &netErr) || unreachable(err):
+		// Not a certificate problem, let failover and retries handle it.
+		return err
+	default:
+		err = fmt.Errorf("TLS connection to controller %s failed: %v", controller, err)
+	}
+	return apiError{codeTLSFailed, err}
+}
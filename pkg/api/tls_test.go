@@ -0,0 +1,210 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by parent or itself.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+var testSerial int64
+
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Expected a key, got %v", err)
+	}
+	testSerial++
+	tmpl.SerialNumber = big.NewInt(testSerial)
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Expected a certificate, got %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Expected the certificate to parse, got %v", err)
+	}
+	return testCert{cert: cert, key: key, der: der}
+}
+
+func newTestCA(t *testing.T, name string) testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newTestLeaf(t *testing.T, ca testCert, tmpl *x509.Certificate) testCert {
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	return newTestCert(t, tmpl, &ca)
+}
+
+func (c testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// write stores the certificate and its key in dir as PEM and returns the
+// file names.
+func (c testCert) write(t *testing.T, dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if err != nil {
+		t.Fatalf("Expected to write %s, got %v", certFile, err)
+	}
+	key, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("Expected to marshal key, got %v", err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	if err != nil {
+		t.Fatalf("Expected to write %s, got %v", keyFile, err)
+	}
+	return certFile, keyFile
+}
+
+// newTestServer starts an HTTPS server with cert, that requires client
+// certificates signed by clientCA if it is set and speaks TLS up to
+// maxVersion, if that is set. Without cert, it serves plain HTTP.
+func newTestServer(cert *testCert, clientCA *testCert, maxVersion uint16) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	if cert == nil {
+		srv.Start()
+		return srv
+	}
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert.tls()}, MaxVersion: maxVersion}
+	if clientCA != nil {
+		srv.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		srv.TLS.ClientCAs = x509.NewCertPool()
+		srv.TLS.ClientCAs.AddCert(clientCA.cert)
+	}
+	srv.StartTLS()
+	return srv
+}
+
+func TestCheckTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linstor-flexvolume-tls")
+	if err != nil {
+		t.Fatalf("Expected a temporary directory, got %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "test CA")
+	otherCA := newTestCA(t, "other CA")
+	local := &x509.Certificate{Subject: pkix.Name{CommonName: "controller"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}}
+
+	valid := newTestLeaf(t, ca, local)
+	unknown := newTestLeaf(t, otherCA, &x509.Certificate{Subject: local.Subject, IPAddresses: local.IPAddresses})
+	wrongName := newTestLeaf(t, ca, &x509.Certificate{Subject: local.Subject, DNSNames: []string{"other.example.com"}})
+	named := newTestLeaf(t, ca, &x509.Certificate{Subject: local.Subject, DNSNames: []string{"controller.example.com"}})
+	expired := newTestLeaf(t, ca, &x509.Certificate{Subject: local.Subject, IPAddresses: local.IPAddresses,
+		NotBefore: time.Now().Add(-48 * time.Hour), NotAfter: time.Now().Add(-24 * time.Hour)})
+	client := newTestLeaf(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "client"}})
+
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := client.write(t, dir, "client")
+
+	var tableTests = []struct {
+		name     string
+		cert     *testCert
+		clientCA *testCert
+		max      uint16
+		settings tlsSettings
+		want     string
+	}{
+		{"valid", &valid, nil, 0, tlsSettings{CAFile: caFile}, ""},
+		{"client certificate", &valid, &ca, 0, tlsSettings{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, ""},
+		{"unknown CA", &unknown, nil, 0, tlsSettings{CAFile: caFile}, "is not signed by a CA in " + caFile},
+		{"wrong name", &wrongName, nil, 0, tlsSettings{CAFile: caFile}, "is not valid for \"127.0.0.1\""},
+		{"expired", &expired, nil, 0, tlsSettings{CAFile: caFile}, "has expired or is not valid yet"},
+		{"missing client certificate", &valid, &ca, 0, tlsSettings{CAFile: caFile}, "rejected the TLS connection with no client certificate"},
+		{"plain HTTP", nil, nil, 0, tlsSettings{CAFile: caFile}, "did not answer with TLS"},
+		{"server name", &named, nil, 0, tlsSettings{CAFile: caFile, ServerName: "controller.example.com"}, ""},
+		{"other server name", &valid, nil, 0, tlsSettings{CAFile: caFile, ServerName: "controller.example.com"},
+			"is not valid for \"controller.example.com\", set serverName"},
+		{"minimum version", &valid, nil, 0, tlsSettings{CAFile: caFile, MinVersion: "1.3"}, ""},
+		{"old version", &valid, nil, tls.VersionTLS12, tlsSettings{CAFile: caFile, MinVersion: "1.3"},
+			"does not support TLS 1.3 or later"},
+		{"unknown version", &valid, nil, 0, tlsSettings{CAFile: caFile, MinVersion: "1.4"}, "must be 1.0, 1.1, 1.2 or 1.3"},
+	}
+
+	for _, tt := range tableTests {
+		tlsChecked = map[string]bool{}
+		srv := newTestServer(tt.cert, tt.clientCA, tt.max)
+		controller := strings.TrimPrefix(strings.TrimPrefix(srv.URL, "https://"), "http://")
+
+		err := checkTLS(tt.settings, controller)
+		srv.Close()
+
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("Expected %s to pass, got %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("Expected %s to fail with %q, got success", tt.name, tt.want)
+			continue
+		}
+		if code := errorCodeOf(err); code != codeTLSFailed {
+			t.Errorf("Expected code %s for %s, got %s", codeTLSFailed, tt.name, code)
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Expected %s to fail with %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
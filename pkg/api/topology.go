@@ -0,0 +1,279 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Kubernetes topology labels and the LINSTOR node aux properties they are
+// mapped to, unless the node config says otherwise. replicasOnSame and
+// replicasOnDifferent refer to the aux properties by these names. Kubernetes
+// has no well-known label for racks, one has to be mapped in the node config.
+var defaultTopologyLabels = map[string]string{
+	"topology.kubernetes.io/region":            "region",
+	"topology.kubernetes.io/zone":              "zone",
+	"failure-domain.beta.kubernetes.io/region": "region",
+	"failure-domain.beta.kubernetes.io/zone":   "zone",
+}
+
+// Kubelet's kubeconfig is used to read the node's labels.
+const defaultKubeconfig = "/etc/kubernetes/kubelet.conf"
+
+// placement describes where replicas of a resource have to go.
+type placement struct {
+	replicas  uint64
+	same      []string
+	different []string
+}
+
+func (p placement) String() string {
+	s := fmt.Sprintf("%d replicas", p.replicas)
+	if len(p.same) != 0 {
+		s += fmt.Sprintf(" on the same %s", strings.Join(p.same, ", "))
+	}
+	if len(p.different) != 0 {
+		s += fmt.Sprintf(" on different %s", strings.Join(p.different, ", "))
+	}
+	return s
+}
+
+// selectNodes picks nodes for the replicas out of candidates. Nodes that lack
+// an aux property the placement refers to are not eligible.
+func (p placement) selectNodes(candidates []node) ([]string, error) {
+	sorted := append([]node{}, candidates...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	// Nodes are grouped by the values of the properties replicas share.
+	groups := map[string][]node{}
+	var keys []string
+	for _, n := range sorted {
+		values, ok := n.auxValues(p.same)
+		if !ok {
+			continue
+		}
+		if _, ok := n.auxValues(p.different); !ok {
+			continue
+		}
+		k := strings.Join(values, "\x00")
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], n)
+	}
+
+	var best []string
+	for _, k := range keys {
+		var picked []string
+		used := make([]map[string]bool, len(p.different))
+		for i := range used {
+			used[i] = map[string]bool{}
+		}
+
+		for _, n := range groups[k] {
+			values, _ := n.auxValues(p.different)
+			clash := false
+			for i, v := range values {
+				clash = clash || used[i][v]
+			}
+			if clash {
+				continue
+			}
+			for i, v := range values {
+				used[i][v] = true
+			}
+			picked = append(picked, n.Name)
+			if uint64(len(picked)) == p.replicas {
+				return picked, nil
+			}
+		}
+		if len(picked) > len(best) {
+			best = picked
+		}
+	}
+
+	return nil, apiError{codePlacementFailed, fmt.Errorf("unable to place %s, at most %d nodes qualify (%s)",
+		p, len(best), strings.Join(best, ", "))}
+}
+
+// topologyMapping returns the labels to map and the properties they become.
+// An empty topologyLabels in the node config turns the mapping off.
+func (c nodeConfig) topologyMapping() map[string]string {
+	if c.TopologyLabels == nil {
+		return defaultTopologyLabels
+	}
+	return c.TopologyLabels
+}
+
+// nodeLabels reads the Kubernetes labels of node with kubectl.
+func nodeLabels(cfg nodeConfig, node string) (map[string]string, error) {
+	kubeconfig := cfg.Kubeconfig
+	if kubeconfig == "" {
+		kubeconfig = defaultKubeconfig
+	}
+	out, err := run("kubectl", "--kubeconfig", kubeconfig, "--request-timeout", "10s", "get", "node", node, "-o", "json")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get labels of node %s: %v: %s", node, err, out)
+	}
+	k8sNode := struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(out, &k8sNode); err != nil {
+		return nil, fmt.Errorf("couldn't Unmarshal %s :%v", out, err)
+	}
+	return k8sNode.Metadata.Labels, nil
+}
+
+// syncTopology copies the topology labels of node to aux properties of the
+// LINSTOR node, where they differ, and returns the properties.
+func syncTopology(cfg nodeConfig, c linstorClient, node string) (map[string]string, error) {
+	mapping := cfg.topologyMapping()
+	if len(mapping) == 0 {
+		return nil, nil
+	}
+
+	labels, err := nodeLabels(cfg, node)
+	if err != nil {
+		return nil, err
+	}
+	aux := mapLabels(mapping, labels)
+
+	nodes, err := c.nodes()
+	if err != nil {
+		return nil, err
+	}
+	changed := map[string]string{}
+	for _, n := range nodes {
+		if n.Name != node {
+			continue
+		}
+		for k, v := range aux {
+			if n.Props.get(k) != v {
+				changed[k] = v
+			}
+		}
+	}
+	if err := c.setNodeProps(node, changed); err != nil {
+		return nil, err
+	}
+	if len(changed) != 0 {
+		log.Printf("node %s topology: %s", node, formatProps(aux))
+	}
+	return aux, nil
+}
+
+// Labels with this prefix are deprecated in favor of topology.kubernetes.io.
+const betaTopologyPrefix = "failure-domain.beta.kubernetes.io/"
+
+// mapLabels returns the aux properties mapping gives labels. If several
+// labels map to the same property, the first one set wins: labels other than
+// the deprecated beta ones first, and by name among those.
+func mapLabels(mapping, labels map[string]string) map[string]string {
+	var names []string
+	for label := range mapping {
+		names = append(names, label)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		bi, bj := strings.HasPrefix(names[i], betaTopologyPrefix), strings.HasPrefix(names[j], betaTopologyPrefix)
+		if bi != bj {
+			return bj
+		}
+		return names[i] < names[j]
+	})
+
+	aux := map[string]string{}
+	for _, label := range names {
+		prop := "Aux/" + mapping[label]
+		if v, ok := labels[label]; ok {
+			if _, set := aux[prop]; !set {
+				aux[prop] = v
+			}
+		}
+	}
+	return aux
+}
+
+func formatProps(kv map[string]string) string {
+	var set []string
+	for k, v := range kv {
+		set = append(set, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(set)
+	return strings.Join(set, ", ")
+}
+
+// startTopologySync runs the topology command in the background, so that the
+// node's labels are mapped without holding up the call that starts it.
+func startTopologySync(cfg nodeConfig) {
+	if len(cfg.topologyMapping()) == 0 {
+		return
+	}
+	self, err := os.Executable()
+	if err == nil {
+		cmd := exec.Command(self, "topology")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Printf("unable to start mapping topology labels: %v", err)
+	}
+}
+
+// topology maps this node's Kubernetes topology labels to LINSTOR node aux
+// properties, so auto-placement can spread replicas across failure domains.
+// It runs by itself on init and install, and can be run by hand.
+func (api FlexVolumeApi) topology(args []string) (string, int) {
+	flags := api.newFlagSet()
+	controllers := flags.String("controllers", "", "LINSTOR controllers, overrides the node config")
+	if err := flags.Parse(args); err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	localNode, err := cfg.localNode()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+	if len(cfg.topologyMapping()) == 0 {
+		return api.fmtAPIError(fmt.Errorf("topology mapping is turned off, topologyLabels is empty"))
+	}
+
+	aux, err := syncTopology(cfg, adminClient(cfg, *controllers), localNode)
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	res, _ := json.Marshal(response{
+		Status:  "Success",
+		Message: fmt.Sprintf("set %s on node %s", formatProps(aux), localNode),
+	})
+	return string(res), EXITSUCCESS
+}
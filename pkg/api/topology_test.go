@@ -0,0 +1,109 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func auxNode(name string, kv ...string) node {
+	n := node{Name: name}
+	for i := 0; i+1 < len(kv); i += 2 {
+		n.Props = append(n.Props, prop{Key: "Aux/" + kv[i], Value: kv[i+1]})
+	}
+	return n
+}
+
+func TestSelectNodes(t *testing.T) {
+	nodes := []node{
+		auxNode("d", "zone", "b", "rack", "2"),
+		auxNode("a", "zone", "a", "rack", "1"),
+		auxNode("c", "zone", "b", "rack", "1"),
+		auxNode("b", "zone", "a", "rack", "2"),
+		auxNode("e"),
+	}
+
+	var tableTests = []struct {
+		p        placement
+		expected []string
+	}{
+		{placement{replicas: 2}, []string{"a", "b"}},
+		{placement{replicas: 5}, []string{"a", "b", "c", "d", "e"}},
+		{placement{replicas: 2, different: []string{"zone"}}, []string{"a", "c"}},
+		{placement{replicas: 2, same: []string{"zone"}}, []string{"a", "b"}},
+		{placement{replicas: 2, same: []string{"rack"}, different: []string{"zone"}}, []string{"a", "c"}},
+		{placement{replicas: 2, same: []string{"zone"}, different: []string{"rack"}}, []string{"a", "b"}},
+		{placement{replicas: 3, different: []string{"zone"}}, nil},
+		{placement{replicas: 3, same: []string{"zone"}}, nil},
+		{placement{replicas: 5, different: []string{"rack"}}, nil},
+		{placement{replicas: 1, same: []string{"row"}}, nil},
+	}
+
+	for _, tt := range tableTests {
+		selected, err := tt.p.selectNodes(nodes)
+		if tt.expected == nil {
+			if err == nil {
+				t.Errorf("Expected placing %s to fail, got %v", tt.p, selected)
+			} else if errorCodeOf(err) != codePlacementFailed {
+				t.Errorf("Expected code %s placing %s, got %s", codePlacementFailed, tt.p, errorCodeOf(err))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected placing %s to succeed, got %v", tt.p, err)
+			continue
+		}
+		if !reflect.DeepEqual(selected, tt.expected) {
+			t.Errorf("Expected %v for %s, got %v", tt.expected, tt.p, selected)
+		}
+	}
+}
+
+func TestMapLabels(t *testing.T) {
+	var tableTests = []struct {
+		mapping  map[string]string
+		labels   map[string]string
+		expected map[string]string
+	}{
+		{defaultTopologyLabels, map[string]string{
+			"topology.kubernetes.io/zone":            "new",
+			"failure-domain.beta.kubernetes.io/zone": "old",
+		}, map[string]string{"Aux/zone": "new"}},
+		{defaultTopologyLabels, map[string]string{
+			"failure-domain.beta.kubernetes.io/zone":   "old",
+			"failure-domain.beta.kubernetes.io/region": "eu",
+		}, map[string]string{"Aux/zone": "old", "Aux/region": "eu"}},
+		{map[string]string{"b.example.com/rack": "rack", "a.example.com/rack": "rack"}, map[string]string{
+			"a.example.com/rack": "1",
+			"b.example.com/rack": "2",
+		}, map[string]string{"Aux/rack": "1"}},
+		{defaultTopologyLabels, map[string]string{"example.com/rack": "1"}, map[string]string{}},
+	}
+
+	for _, tt := range tableTests {
+		// Map order is random, a few runs should catch an unstable result.
+		for i := 0; i < 10; i++ {
+			if aux := mapLabels(tt.mapping, tt.labels); !reflect.DeepEqual(aux, tt.expected) {
+				t.Errorf("Expected %v for %v, got %v", tt.expected, tt.labels, aux)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+* Linstor Flexvolume plugin for Kubernetes.
+* Copyright © 2018 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+type trimResult struct {
+	Volume       string `json:"volume"`
+	Device       string `json:"device"`
+	MountPath    string `json:"mountPath"`
+	TrimmedBytes int64  `json:"trimmedBytes"`
+	Duration     string `json:"duration"`
+	Error        string `json:"error,omitempty"`
+}
+
+type trimResponse struct {
+	response
+	Volumes []trimResult `json:"volumes"`
+}
+
+var fstrimBytesRe = regexp.MustCompile(`\((\d+) bytes\)`)
+
+// trim discards unused blocks of every volume the driver mounted on this
+// node, handing them back to thin provisioned storage pools. Volumes are
+// trimmed one after the other, pausing in between to limit the load on the
+// pools.
+func (api FlexVolumeApi) trim(args []string) (string, int) {
+	flags := api.newFlagSet()
+	pause := flags.Duration("pause", 2*time.Second, "time to wait between trimming two volumes")
+	if err := flags.Parse(args); err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	cfg, err := loadNodeConfig()
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	mounts, err := driverMounts(cfg.mountsDir())
+	if err != nil {
+		return api.fmtAPIError(err)
+	}
+
+	resp := trimResponse{
+		response: response{Status: "Success"},
+		Volumes:  []trimResult{},
+	}
+	ret := EXITSUCCESS
+
+	for i, m := range mounts {
+		if i > 0 {
+			time.Sleep(*pause)
+		}
+
+		res := trimResult{
+			Volume:    filepath.Base(m.Target),
+			Device:    m.Source,
+			MountPath: m.Target,
+		}
+
+		start := time.Now()
+		out, err := change("fstrim", "--verbose", m.Target)
+		res.Duration = time.Since(start).String()
+		if err != nil {
+			res.Error = fmt.Sprintf("%v: %s", err, out)
+			resp.Status = "Failure"
+			ret = EXITBADAPICALL
+		} else if match := fstrimBytesRe.FindSubmatch(out); match != nil {
+			res.TrimmedBytes, _ = strconv.ParseInt(string(match[1]), 10, 64)
+		}
+
+		resp.Volumes = append(resp.Volumes, res)
+	}
+
+	res, _ := json.Marshal(resp)
+	return string(res), ret
+}